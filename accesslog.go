@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogger writes one line for every finished tunnel, it's nil when
+// access log is disabled.
+var accessLogger *log.Logger
+
+// tunnel records a client connection for the access log.
+type tunnel struct {
+	client      string
+	country     string // empty when GeoIP is disabled or unknown
+	id          string
+	target      string
+	remote      string // address connected for target, empty through upstream proxy
+	accepted    time.Time
+	deadline    time.Time // end of setup budget, zero when unlimited
+	established time.Time
+	read        time.Duration // reading and decrypting handshake
+	dial        time.Duration // dialing target, including retries
+	transfer    time.Duration // from succeed code to first side closed
+	sent        int64         // client to target, including handshake remainder
+	received    int64         // target to client
+	reason      string
+	limit       *connLimit   // connection limit of the listener
+	buffer      int          // copy buffer size
+	protocol    string       // empty when not classified or client sent nothing
+	killed      atomic.Value // reason when closed by gateway, such as "shed"
+	targetConn  net.Conn     // connection to target before wrappers
+}
+
+// kill records why the gateway closes the tunnel, it must be called before
+// the connections are closed.
+func (tun *tunnel) kill(reason string) {
+	tun.killed.Store(reason)
+}
+
+// timeout caps d by the remaining setup budget, it's not positive when the
+// budget is used up.
+func (tun *tunnel) timeout(d time.Duration) time.Duration {
+	if tun.deadline.IsZero() {
+		return d
+	}
+	if remain := time.Until(tun.deadline); remain < d {
+		return remain
+	}
+	return d
+}
+
+// openAccessLog opens the access log of format, "text" lines are prefixed
+// by the local time, "logfmt" lines have the time as a field.
+func openAccessLog(path, format string) (*log.Logger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if format == "logfmt" {
+		return log.New(f, "", 0), nil
+	}
+	return log.New(f, "", log.LstdFlags), nil
+}
+
+func accessLog(tun *tunnel) {
+	if accessLogger == nil {
+		return
+	}
+	// successful tunnels are only counted by metrics
+	if cfgLogFailures && (tun.reason == "clean" || tun.reason == "active") {
+		return
+	}
+	if cfgLogFormat == "logfmt" {
+		accessLogger.Print(tun.logfmt())
+		return
+	}
+	accessLogger.Print(tun.String())
+}
+
+// accessLogFailure writes a line for a connection failed before the tunnel
+// is established when logfailures is enabled, the reason is the limit which
+// rejected it, "dial", "verify" or "handshake".
+func accessLogFailure(tun *tunnel) {
+	if !cfgLogFailures {
+		return
+	}
+	accessLog(tun)
+}
+
+// fields returns the access log fields of tun as key and value pairs, the
+// optional ones are left out when they have nothing to tell.
+func (tun *tunnel) fields() [][2]string {
+	fields := [][2]string{
+		{"client", tun.client},
+		{"key", tun.id},
+		{"target", tun.target},
+		{"read", tun.read.String()},
+		{"dial", tun.dial.String()},
+		{"transfer", tun.transfer.String()},
+		{"sent", strconv.FormatInt(tun.sent, 10)},
+		{"received", strconv.FormatInt(tun.received, 10)},
+		{"reason", tun.reason},
+	}
+	if tun.country != "" {
+		fields = append(fields, [2]string{"country", tun.country})
+	}
+	// resolved address of hostname target, to find unexpected resolutions
+	if tun.remote != "" && tun.remote != tun.target {
+		fields = append(fields, [2]string{"remote", tun.remote})
+	}
+	if tun.protocol != "" {
+		fields = append(fields, [2]string{"protocol", tun.protocol})
+	}
+	if tun.buffer != 0 && tun.buffer != int(cfgBufferSize) {
+		fields = append(fields, [2]string{"buffer", strconv.Itoa(tun.buffer)})
+	}
+	return fields
+}
+
+func (tun *tunnel) String() string {
+	var b strings.Builder
+	for i, f := range tun.fields() {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f[0])
+		b.WriteByte('=')
+		// key ID and target are given by clients, a target with spaces or
+		// newlines must not forge fields or lines
+		switch f[0] {
+		case "key":
+			b.WriteString(strconv.Quote(f[1]))
+		case "target":
+			b.WriteString(logfmtValue(f[1]))
+		default:
+			b.WriteString(f[1])
+		}
+	}
+	return b.String()
+}
+
+// logfmt formats tun as a logfmt line with the time in RFC 3339, values
+// are quoted when needed so log parsers can split them.
+func (tun *tunnel) logfmt() string {
+	var b strings.Builder
+	b.WriteString("time=" + time.Now().Format(time.RFC3339))
+	for _, f := range tun.fields() {
+		b.WriteString(" " + f[0] + "=" + logfmtValue(f[1]))
+	}
+	return b.String()
+}
+
+// logfmtValue quotes v when it's empty or has spaces, equal signs, quotes
+// or control characters.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =") || strconv.Quote(v) != `"`+v+`"` {
+		return strconv.Quote(v)
+	}
+	return v
+}
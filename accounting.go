@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelAccount counts the bytes of a tunnel while it's alive, so long
+// tunnels can report interim byte counts before they are closed.
+type tunnelAccount struct {
+	tun      *tunnel
+	sent     int64 // updated atomically by the client connection
+	received int64 // updated atomically by the target connection
+	flushed  [2]int64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newTunnelAccount wraps the connections of tun to count the bytes, and
+// flushes the counts every interval until stopped.
+func newTunnelAccount(tun *tunnel, conn, agent net.Conn, interval time.Duration) (*tunnelAccount, net.Conn, net.Conn) {
+	a := &tunnelAccount{
+		tun:  tun,
+		sent: tun.sent,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go a.loop(interval)
+	return a, &countConn{Conn: conn, n: &a.sent}, &countConn{Conn: agent, n: &a.received}
+}
+
+func (a *tunnelAccount) loop(interval time.Duration) {
+	defer close(a.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// flush adds the bytes since last flush to metrics and writes an interim
+// access log line with reason "active".
+func (a *tunnelAccount) flush() {
+	sent := atomic.LoadInt64(&a.sent)
+	received := atomic.LoadInt64(&a.received)
+	transferBytes.Add("sent", sent-a.flushed[0])
+	transferBytes.Add("received", received-a.flushed[1])
+	a.flushed = [2]int64{sent, received}
+	interimFlushes.Add(1)
+	accessLog(&tunnel{
+		client:   a.tun.client,
+		country:  a.tun.country,
+		id:       a.tun.id,
+		target:   a.tun.target,
+		remote:   a.tun.remote,
+		read:     a.tun.read,
+		dial:     a.tun.dial,
+		transfer: time.Since(a.tun.established),
+		sent:     sent,
+		received: received,
+		reason:   "active",
+		buffer:   a.tun.buffer,
+	})
+}
+
+// close stops flushing, the final counts of tunnel are added by
+// countTransfer.
+func (a *tunnelAccount) close() {
+	close(a.stop)
+	<-a.done
+}
+
+// countTransfer adds the bytes of a finished tunnel which are not flushed
+// yet to metrics.
+func countTransfer(tun *tunnel, a *tunnelAccount) {
+	sent, received := tun.sent, tun.received
+	if a != nil {
+		sent -= a.flushed[0]
+		received -= a.flushed[1]
+	}
+	transferBytes.Add("sent", sent)
+	transferBytes.Add("received", received)
+}
+
+type countConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.AddInt64(c.n, int64(n))
+	}
+	return n, err
+}
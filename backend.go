@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// backends counts the tunnels of every backend IP for backendmax.
+var backends = &backendLimits{conns: make(map[string]int64)}
+
+// backendLimits caps the tunnels by the IP actually connected, which is
+// shared by hostnames resolving to the same IP and split between the IPs of
+// one hostname.
+type backendLimits struct {
+	mu    sync.Mutex
+	conns map[string]int64
+}
+
+func (l *backendLimits) acquire(ip string, max int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+// release forgets the IP without tunnels, so the map doesn't grow with all
+// the backends ever connected.
+func (l *backendLimits) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// backendConn releases the backend slot when closed.
+type backendConn struct {
+	net.Conn
+	ip   string
+	once sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() {
+		backends.release(c.ip)
+	})
+	return c.Conn.Close()
+}
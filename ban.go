@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// bans is nil when banning is disabled.
+var bans *banList
+
+// banList refuses the connections of client IPs which failed handshake too
+// many times in a window, such as guessing the secret, until a cooldown
+// passed.
+type banList struct {
+	mu       sync.Mutex
+	fails    int
+	window   time.Duration
+	cooldown time.Duration
+	clients  map[string]*banRecord
+	sweepAt  int
+}
+
+type banRecord struct {
+	fails int
+	since time.Time // start of the failure window
+	until time.Time // end of the ban
+}
+
+func newBanList(fails int, window, cooldown time.Duration) *banList {
+	return &banList{
+		fails:    fails,
+		window:   window,
+		cooldown: cooldown,
+		clients:  make(map[string]*banRecord),
+		sweepAt:  1024,
+	}
+}
+
+// failed records a handshake failure, it reports whether the client is
+// banned by this failure.
+func (l *banList) failed(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.clients) >= l.sweepAt {
+		l.sweep(now)
+	}
+	r := l.clients[ip]
+	if r == nil || now.Sub(r.since) > l.window {
+		r = &banRecord{since: now, until: r.bannedUntil()}
+		l.clients[ip] = r
+	}
+	r.fails++
+	if r.fails < l.fails {
+		return false
+	}
+	r.fails = 0
+	r.since = now
+	r.until = now.Add(l.cooldown)
+	return true
+}
+
+func (l *banList) banned(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.clients[ip]
+	return r != nil && time.Now().Before(r.until)
+}
+
+// sweep forgets the clients which are neither banned nor in a failure
+// window, so scanners from many addresses can't grow the list forever.
+func (l *banList) sweep(now time.Time) {
+	for ip, r := range l.clients {
+		if now.Sub(r.since) > l.window && !now.Before(r.until) {
+			delete(l.clients, ip)
+		}
+	}
+	l.sweepAt = 2 * len(l.clients)
+	if l.sweepAt < 1024 {
+		l.sweepAt = 1024
+	}
+}
+
+func (r *banRecord) bannedUntil() time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+	return r.until
+}
+
+// handshakeFailed records a failure for the client of conn when banning is
+// enabled.
+func handshakeFailed(conn net.Conn) {
+	if bans == nil {
+		return
+	}
+	ip := clientIP(conn.RemoteAddr())
+	if bans.failed(ip) {
+		printf("Client %s banned for %s after %d handshake failures", ip, bans.cooldown, bans.fails)
+	}
+}
+
+func clientIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// byteCap closes a tunnel with reason "maxbytes" once the bytes of both
+// directions add up to more than the limit. The bytes sent during handshake
+// are counted too.
+type byteCap struct {
+	tun         *tunnel
+	conn, agent net.Conn
+	limit       int64
+	total       int64 // updated atomically by both directions
+	once        int32
+}
+
+// capBytes wraps the connections of tun to count the bytes of both
+// directions against limit.
+func capBytes(tun *tunnel, conn, agent net.Conn, limit int64) (net.Conn, net.Conn) {
+	c := &byteCap{tun: tun, conn: conn, agent: agent, limit: limit, total: tun.sent + tun.received}
+	return &capConn{Conn: conn, c: c}, &capConn{Conn: agent, c: c}
+}
+
+func (c *byteCap) add(n int) {
+	if atomic.AddInt64(&c.total, int64(n)) <= c.limit {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.once, 0, 1) {
+		return
+	}
+	c.tun.kill("maxbytes")
+	c.conn.Close()
+	c.agent.Close()
+}
+
+type capConn struct {
+	net.Conn
+	c *byteCap
+}
+
+func (c *capConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.c.add(n)
+	}
+	return n, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"net"
+)
+
+// protocolStats counts the tunnels by protocol of the first client data.
+var protocolStats = expvar.NewMap("protocols")
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+	[]byte("TRACE "),
+}
+
+// classify guesses the application protocol from the first bytes sent by
+// client, it's best-effort and only looks at the start of the data.
+func classify(p []byte) string {
+	switch {
+	case len(p) == 0:
+		return ""
+	case bytes.HasPrefix(p, []byte("PRI * HTTP/2")):
+		return "http2"
+	case len(p) >= 3 && p[0] == 0x16 && p[1] == 0x03 && p[2] <= 0x04:
+		// handshake record of SSL 3.0 to TLS 1.3
+		return "tls"
+	case bytes.HasPrefix(p, []byte("SSH-")):
+		return "ssh"
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(p, m) {
+			return "http"
+		}
+	}
+	return "unknown"
+}
+
+// classifyConn labels the tunnel by the first data written to the agent,
+// the stream is passed through untouched.
+type classifyConn struct {
+	net.Conn
+	tun  *tunnel
+	done bool
+}
+
+func (c *classifyConn) Write(p []byte) (int, error) {
+	if !c.done && len(p) > 0 {
+		c.tun.protocol = classify(p)
+		c.done = true
+	}
+	return c.Conn.Write(p)
+}
+
+func countProtocol(protocol string) {
+	if protocol == "" {
+		protocol = "none"
+	}
+	protocolStats.Add(protocol, 1)
+}
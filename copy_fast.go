@@ -1,12 +1,44 @@
-// +build go1.5
+// +build !nopool
 
 package main
 
-import "io"
+import (
+	"io"
+	"sync/atomic"
+)
 
-func copy(dst io.WriteCloser, src io.ReadCloser) {
-	b := copyBufPool.Get().(*[]byte)
+// copyPool names how copy buffers are managed, reported by metrics.
+const copyPool = "sync.Pool"
+
+// copy uses a pooled buffer when size is the configured buffer size, other
+// sizes negotiated by clients are allocated for the tunnel. Only the copies
+// between plain TCP connections with the configured size are left to
+// TCPConn.ReadFrom, so they can be spliced by the kernel.
+func copy(dst io.WriteCloser, src io.ReadCloser, size int) (int64, error) {
+	pooled := size == int(cfgBufferSize)
+	var b *[]byte
+	if pooled {
+		b = copyBufPool.Get().(*[]byte)
+	} else {
+		buf := make([]byte, size)
+		b = &buf
+	}
 	buf := *b
-	io.CopyBuffer(dst, src, buf)
-	copyBufPool.Put(b)
+	atomic.AddInt64(&copyBufBytes, int64(len(buf)))
+	var n int64
+	var err error
+	if pooled && splicing(dst, src) {
+		n, err = io.CopyBuffer(dst, src, buf)
+	} else {
+		r := &countReader{Reader: src}
+		n, err = io.CopyBuffer(writerOnly{dst}, r, buf)
+		if pooled {
+			checkBufferSize(r.n, r.reads)
+		}
+	}
+	atomic.AddInt64(&copyBufBytes, -int64(len(buf)))
+	if pooled {
+		putCopyBuf(b)
+	}
+	return n, err
 }
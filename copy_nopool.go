@@ -0,0 +1,29 @@
+// +build nopool
+
+package main
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// copyPool names how copy buffers are managed, reported by metrics.
+const copyPool = "none"
+
+// copy allocates a fresh buffer for every copy. Build with "-tags nopool" to
+// rule out the buffer pool when hunting data races or corruption.
+func copy(dst io.WriteCloser, src io.ReadCloser, size int) (int64, error) {
+	configured := size == int(cfgBufferSize)
+	buf := make([]byte, size)
+	atomic.AddInt64(&copyBufBytes, int64(len(buf)))
+	defer atomic.AddInt64(&copyBufBytes, -int64(len(buf)))
+	if configured && splicing(dst, src) {
+		return io.CopyBuffer(dst, src, buf)
+	}
+	r := &countReader{Reader: src}
+	n, err := io.CopyBuffer(writerOnly{dst}, r, buf)
+	if configured {
+		checkBufferSize(r.n, r.reads)
+	}
+	return n, err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lookupHost is replaced by tests to resolve names to several IPs.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// dialPath records the addresses a tunnel dialed in order with their
+// results, so the failover between IPs and retries can be told.
+type dialPath []string
+
+func (p *dialPath) add(addr string, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	*p = append(*p, addr+" ("+result+")")
+}
+
+func (p dialPath) String() string {
+	return strings.Join(p, ", ")
+}
+
+// dial connects to target once, through the upstream proxy if configured,
+// the attempts are added to path. With "total" dial scope the timeout is
+// the budget of all resolved IPs, net.Dialer splits it between them so a
+// few dead IPs can't blow it. With "ip" scope the name is resolved here and
+// every IP gets the full timeout in order.
+func dial(target string, timeout time.Duration, path *dialPath) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err == nil && cfgUpstreamURL == nil && cfgDialScope == "ip" && !isIPLiteral(host) {
+		return dialEachIP(target, host, port, timeout, path)
+	}
+	if cfgUpstreamURL == nil && err == nil && !isIPLiteral(host) && cfgDialPrefer != "" {
+		return dialPreferred(target, timeout, path)
+	}
+	var conn net.Conn
+	if cfgUpstreamURL != nil {
+		conn, err = dialUpstream(target, timeout)
+	} else {
+		conn, err = dialTimeout("tcp", target, timeout)
+	}
+	path.add(target, err)
+	return conn, err
+}
+
+// dialEachIP resolves host and dials its IPs in order until one succeeds.
+func dialEachIP(target, host, port string, timeout time.Duration, path *dialPath) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ips, err := lookupHost(ctx, host)
+	cancel()
+	if err != nil {
+		path.add(target, err)
+		return nil, err
+	}
+	if cfgDialPrefer != "" {
+		preferFamily(ips, cfgDialPrefer == "ipv6")
+	}
+	var firstErr error
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip, port)
+		conn, err := dialTimeout("tcp", addr, timeout)
+		path.add(addr, err)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// dialFallback is net.DialTimeout with the configured Happy Eyeballs delay.
+func dialFallback(network, address string, timeout time.Duration) (net.Conn, error) {
+	return newDialer(timeout).Dial(network, address)
+}
+
+func newDialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout, FallbackDelay: time.Duration(cfgFallback)}
+	if cfgFallback == 0 {
+		// negative disables racing the address families
+		d.FallbackDelay = -1
+	}
+	return d
+}
+
+// dialPreferred dials the IPs of preferred family first with half of
+// timeout, then the other family with the rest, instead of racing them by
+// the dialer. A blackholed preferred family can't use up the whole timeout,
+// and one without address leaves nearly all to the other. Both attempts are
+// added to path. When both fail, the error of preferred
+// family is returned unless the target has no address of that family.
+func dialPreferred(target string, timeout time.Duration, path *dialPath) (net.Conn, error) {
+	first, second := "tcp4", "tcp6"
+	if cfgDialPrefer == "ipv6" {
+		first, second = second, first
+	}
+	deadline := time.Now().Add(timeout)
+	conn, err := dialTimeout(first, target, timeout/2)
+	path.add(first+" "+target, err)
+	if err == nil {
+		return conn, nil
+	}
+	remain := time.Until(deadline)
+	if remain <= 0 {
+		return nil, err
+	}
+	conn, err2 := dialTimeout(second, target, remain)
+	path.add(second+" "+target, err2)
+	if err2 == nil {
+		return conn, nil
+	}
+	if noAddress(err) {
+		return nil, err2
+	}
+	return nil, err
+}
+
+// noAddress reports whether a dial failed because the target has no
+// address of the network family.
+func noAddress(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	_, ok := err.(*net.AddrError)
+	return ok
+}
+
+// preferFamily moves the IPs of preferred family to the front, keeping the
+// resolved order in each family.
+func preferFamily(ips []string, ipv6 bool) {
+	sort.SliceStable(ips, func(i, j int) bool {
+		return isIPv6(ips[i]) == ipv6 && isIPv6(ips[j]) != ipv6
+	})
+}
+
+func isIPv6(ip string) bool {
+	return strings.Contains(ip, ":")
+}
+
+// isIPLiteral reports whether host is an IP address, including IPv6 with a
+// zone such as "fe80::1%eth0", which needs no resolution.
+func isIPLiteral(host string) bool {
+	if i := strings.LastIndexByte(host, '%'); i > 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host) != nil
+}
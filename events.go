@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventQueueSize    = 1024
+	eventWriteTimeout = time.Second
+	eventRetryDelay   = time.Second
+)
+
+// events is nil when event publishing is disabled.
+var events *eventPublisher
+
+type tunnelEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Key      string    `json:"key,omitempty"`
+	Target   string    `json:"target"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// parseEventBroker parses a broker URL such as "nats://host:4222/subject",
+// the subject defaults to "gateway.tunnels".
+func parseEventBroker(s string) (addr, subject string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "nats" {
+		return "", "", errors.New("unsupported event broker: " + u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", "", errors.New("bad event broker address: " + u.Host)
+	}
+	subject = strings.Trim(u.Path, "/")
+	if subject == "" {
+		subject = "gateway.tunnels"
+	}
+	if strings.ContainsAny(subject, " \t\r\n/") {
+		return "", "", errors.New("bad event subject: " + subject)
+	}
+	return u.Host, subject, nil
+}
+
+// eventPublisher publishes tunnel open and close events to a NATS subject
+// in background. Events are dropped when the broker is unreachable or can't
+// keep up, so tunnels are never stalled by it.
+type eventPublisher struct {
+	addr    string
+	subject string
+	mu      sync.Mutex
+	ch      chan []byte
+	closed  bool
+}
+
+func newEventPublisher(addr, subject string) *eventPublisher {
+	p := &eventPublisher{
+		addr:    addr,
+		subject: subject,
+		ch:      make(chan []byte, eventQueueSize),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *eventPublisher) publish(event string, tun *tunnel) {
+	b, err := json.Marshal(&tunnelEvent{
+		Event:    event,
+		Time:     time.Now(),
+		Client:   tun.client,
+		Key:      tun.id,
+		Target:   tun.target,
+		Sent:     tun.sent,
+		Received: tun.received,
+		Reason:   tun.reason,
+	})
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.ch <- b:
+	default:
+		droppedEvents.Add(1)
+	}
+}
+
+func (p *eventPublisher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	close(p.ch)
+}
+
+func (p *eventPublisher) loop() {
+	for {
+		conn, r, err := p.connect()
+		if err != nil {
+			printf("Event broker connect failed: %s", err)
+			if !p.drop(eventRetryDelay) {
+				return
+			}
+			continue
+		}
+		ok := p.send(conn, r)
+		conn.Close()
+		if !ok {
+			return
+		}
+	}
+}
+
+// connect dials the broker and finishes the NATS handshake, the server
+// sends INFO first and the client replies CONNECT.
+func (p *eventPublisher) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, time.Duration(cfgDialTimeout))
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(cfgDialTimeout)))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, nil, errors.New("unexpected broker greeting: " + strings.TrimSpace(line))
+	}
+	if _, err := conn.Write([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"gateway\"}\r\n")); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// send publishes queued events until the connection fails, it returns false
+// when the publisher is closed.
+func (p *eventPublisher) send(conn net.Conn, r *bufio.Reader) bool {
+	var wmu sync.Mutex
+	write := func(b []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		_, err := conn.Write(b)
+		return err
+	}
+
+	// answer keepalive of server, other messages are ignored
+	failed := make(chan struct{})
+	go func() {
+		defer close(failed)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PING") {
+				if write([]byte("PONG\r\n")) != nil {
+					return
+				}
+			} else if strings.HasPrefix(line, "-ERR") {
+				printf("Event broker error: %s", strings.TrimSpace(line))
+			}
+		}
+	}()
+
+	for {
+		select {
+		case b, ok := <-p.ch:
+			if !ok {
+				return false
+			}
+			msg := make([]byte, 0, len(p.subject)+len(b)+32)
+			msg = append(msg, "PUB "+p.subject+" "+strconv.Itoa(len(b))+"\r\n"...)
+			msg = append(msg, b...)
+			msg = append(msg, "\r\n"...)
+			if err := write(msg); err != nil {
+				droppedEvents.Add(1)
+				return true
+			}
+		case <-failed:
+			return true
+		}
+	}
+}
+
+// drop discards events for a while, it returns false when the publisher is
+// closed.
+func (p *eventPublisher) drop(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-p.ch:
+			if !ok {
+				return false
+			}
+			droppedEvents.Add(1)
+		case <-timer.C:
+			return true
+		}
+	}
+}
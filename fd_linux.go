@@ -0,0 +1,28 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdUsage returns the number of open file descriptors of the process and
+// the soft limit.
+func fdUsage() (open, limit uint64, err error) {
+	f, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, 0, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, err
+	}
+	// the directory itself was open while reading
+	return uint64(len(names) - 1), rlimit.Cur, nil
+}
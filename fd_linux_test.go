@@ -0,0 +1,57 @@
+// +build linux
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/funny/crypto/aes256cbc"
+	"github.com/funny/utest"
+)
+
+func Test_MinFreeFDs(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	open, limit, err := fdUsage()
+	utest.IsNilNow(t, err)
+	utest.Assert(t, open > 0 && limit > open, open, limit)
+
+	oldMin := cfgMinFreeFDs
+	defer func() {
+		cfgMinFreeFDs = oldMin
+		checkFDs()
+	}()
+
+	// no free file descriptors is enough
+	cfgMinFreeFDs = uint(limit)
+	utest.Assert(t, checkFDs())
+
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	go loop(gateway)
+
+	conn, err := net.Dial("tcp", gateway.Addr().String())
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+
+	code := make([]byte, 3)
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err = io.ReadFull(conn, code)
+	utest.NotNilNow(t, err)
+
+	// accepted once recovered
+	cfgMinFreeFDs = 1
+	utest.Assert(t, !checkFDs())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+}
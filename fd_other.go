@@ -0,0 +1,10 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+// fdUsage is only supported on Linux.
+func fdUsage() (open, limit uint64, err error) {
+	return 0, 0, errors.New("file descriptor usage is only supported on Linux")
+}
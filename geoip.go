@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"expvar"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Countries beyond the limit are counted as "other", so a scan from all
+// over the world can't blow up the metrics.
+const maxCountryLabels = 64
+
+var (
+	// geoLookup resolves client IP to country code, it's nil when GeoIP is
+	// disabled.
+	geoLookup func(ip net.IP) string
+
+	// countryStats counts the tunnels by country of client.
+	countryStats  = expvar.NewMap("countries")
+	countryLabels = newLabelSet(maxCountryLabels)
+)
+
+type geoNet struct {
+	start   net.IP // 16 bytes form
+	ipnet   *net.IPNet
+	country string
+}
+
+// geoDB is sorted by network start, the networks must not overlap.
+type geoDB []geoNet
+
+// loadGeoDB reads a text file of "network country" lines, such as
+// "1.0.1.0/24 CN", which can be converted from the GeoLite2 country CSV.
+// Empty lines and lines starting with '#' are ignored.
+func loadGeoDB(path string) (geoDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var db geoDB
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("bad GeoIP line: " + line)
+		}
+		_, ipnet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, errors.New("bad GeoIP network: " + fields[0])
+		}
+		db = append(db, geoNet{ipnet.IP.To16(), ipnet, fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db, func(i, j int) bool {
+		return bytes.Compare(db[i].start, db[j].start) < 0
+	})
+	return db, nil
+}
+
+func (db geoDB) lookup(ip net.IP) string {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	// the last network starts before ip is the only one may contain it
+	i := sort.Search(len(db), func(i int) bool {
+		return bytes.Compare(db[i].start, ip16) > 0
+	})
+	if i > 0 && db[i-1].ipnet.Contains(ip) {
+		return db[i-1].country
+	}
+	return ""
+}
+
+func clientCountry(addr net.Addr) string {
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		return ""
+	}
+	return geoLookup(ip)
+}
+
+func countCountry(country string) {
+	if country == "" {
+		country = "unknown"
+	}
+	countryStats.Add(countryLabels.label(country), 1)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// setKeepAlive is replaced by tests to record the toggles.
+var setKeepAlive = func(conn net.Conn, on bool) error {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		return tc.SetKeepAlive(on)
+	}
+	return nil
+}
+
+// idleKeepAlive enables TCP keepalive of a tunnel only when it's idle for a
+// while, active tunnels need no probes to tell the peers are alive.
+type idleKeepAlive struct {
+	conns   []net.Conn
+	idle    time.Duration
+	last    int64 // unix nanoseconds of last read of either side
+	enabled bool  // only touched by timer
+	stopped int32
+	timer   *time.Timer
+}
+
+// watchIdle disables keepalive of conns and starts watching the reads of
+// the returned wrappers of client and agent.
+func watchIdle(idle time.Duration, conn, agent net.Conn, conns ...net.Conn) (*idleKeepAlive, net.Conn, net.Conn) {
+	k := &idleKeepAlive{conns: conns, idle: idle, last: time.Now().UnixNano()}
+	k.set(false)
+	k.timer = time.AfterFunc(idle, k.check)
+	return k, &idleConn{Conn: conn, k: k}, &idleConn{Conn: agent, k: k}
+}
+
+func (k *idleKeepAlive) check() {
+	if atomic.LoadInt32(&k.stopped) == 1 {
+		return
+	}
+	since := time.Since(time.Unix(0, atomic.LoadInt64(&k.last)))
+	if since >= k.idle {
+		if !k.enabled {
+			k.set(true)
+		}
+		k.timer.Reset(k.idle)
+		return
+	}
+	if k.enabled {
+		k.set(false)
+	}
+	k.timer.Reset(k.idle - since)
+}
+
+func (k *idleKeepAlive) set(on bool) {
+	k.enabled = on
+	for _, conn := range k.conns {
+		if err := setKeepAlive(conn, on); err != nil {
+			printf("Set keepalive failed: %s", err)
+		}
+	}
+}
+
+func (k *idleKeepAlive) stop() {
+	atomic.StoreInt32(&k.stopped, 1)
+	k.timer.Stop()
+}
+
+type idleConn struct {
+	net.Conn
+	k *idleKeepAlive
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.k.last, time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// liveTunnels is nil when the kill switch is disabled.
+var liveTunnels *tunnelRegistry
+
+// killSwitch is 1 while the kill switch is engaged, new connections are
+// refused until it's cleared.
+var killSwitch int32
+
+// tunnelRegistry tracks the established tunnels, so the kill switch can
+// close them all.
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	tunnels map[*tunnel]net.Conn
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{tunnels: make(map[*tunnel]net.Conn)}
+}
+
+// add registers tun, it's closed at once when the kill switch was engaged
+// during its handshake.
+func (r *tunnelRegistry) add(tun *tunnel, conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if atomic.LoadInt32(&killSwitch) == 1 {
+		tun.kill("killswitch")
+		conn.Close()
+		return
+	}
+	r.tunnels[tun] = conn
+}
+
+func (r *tunnelRegistry) remove(tun *tunnel) {
+	r.mu.Lock()
+	delete(r.tunnels, tun)
+	r.mu.Unlock()
+}
+
+// engage closes all tunnels and refuses new connections, it returns how
+// many tunnels were closed.
+func (r *tunnelRegistry) engage() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	atomic.StoreInt32(&killSwitch, 1)
+	n := len(r.tunnels)
+	for tun, conn := range r.tunnels {
+		tun.kill("killswitch")
+		conn.Close()
+		delete(r.tunnels, tun)
+	}
+	printf("Kill switch engaged, closed %d tunnels", n)
+	return n
+}
+
+func (r *tunnelRegistry) clear() {
+	atomic.StoreInt32(&killSwitch, 0)
+	printf("Kill switch cleared")
+}
@@ -0,0 +1,23 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchKillSwitch engages the kill switch on SIGUSR1 and clears it on
+// SIGUSR2.
+func watchKillSwitch(r *tunnelRegistry) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range c {
+		if sig == syscall.SIGUSR1 {
+			r.engage()
+		} else {
+			r.clear()
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// +build windows
+
+package main
+
+// watchKillSwitch does nothing, Windows has no user signals to trigger it.
+func watchKillSwitch(r *tunnelRegistry) {
+	printf("Kill switch signals are not supported on Windows")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How often the free file descriptors are checked.
+const fdCheckInterval = time.Second
+
+// globalConns counts the tunnels of all listeners.
+var globalConns connLimit
+
+// fdLow is 1 while the free file descriptors are below minfreefds, new
+// connections are not accepted until they recover.
+var fdLow int32
+
+// connLimit counts concurrent connections.
+type connLimit struct {
+	n int64
+}
+
+// acquire takes a slot unless there are max connections already, max 0
+// means unlimited.
+func (l *connLimit) acquire(max int64) bool {
+	if n := atomic.AddInt64(&l.n, 1); max > 0 && n > max {
+		atomic.AddInt64(&l.n, -1)
+		return false
+	}
+	return true
+}
+
+func (l *connLimit) release() {
+	atomic.AddInt64(&l.n, -1)
+}
+
+func (l *connLimit) count() int64 {
+	return atomic.LoadInt64(&l.n)
+}
+
+// rejected records that tun is refused by the named limit, one of "ban",
+// "killswitch", "allow", "allowexact", "hostregex", "localonly",
+// "maxtargets", "global", "listener", "tenant" and "backend", and publishes
+// a "reject" event with the limit as reason, so it's clear which limit
+// needs raising.
+func rejected(tun *tunnel, limit string) {
+	rejections.Add(limit, 1)
+	tun.reason = limit
+	if events != nil {
+		events.publish("reject", tun)
+	}
+}
+
+// checkFDs samples the free file descriptors and updates fdLow, it reports
+// whether they are low.
+func checkFDs() bool {
+	open, limit, err := fdUsage()
+	if err != nil {
+		return false
+	}
+	free := uint64(0)
+	if limit > open {
+		free = limit - open
+	}
+	low := free < uint64(cfgMinFreeFDs)
+	if low {
+		if atomic.SwapInt32(&fdLow, 1) == 0 {
+			printf("Stop accepting, %d free file descriptors, expected %d", free, cfgMinFreeFDs)
+		}
+	} else if atomic.SwapInt32(&fdLow, 0) == 1 {
+		printf("Resume accepting, %d free file descriptors", free)
+	}
+	return low
+}
+
+func watchFDs() {
+	for range time.Tick(fdCheckInterval) {
+		checkFDs()
+	}
+}
+
+// waitFDs blocks while the free file descriptors are low.
+func waitFDs() {
+	for atomic.LoadInt32(&fdLow) == 1 {
+		time.Sleep(fdCheckInterval / 10)
+	}
+}
@@ -1,11 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -15,9 +35,27 @@ import (
 
 func init() {
 	isTest = true
+	w := &readyWriter{ready: make(chan struct{})}
+	log.SetOutput(w)
 	cfgSecret = []byte("test")
 	go main()
-	time.Sleep(time.Second * 2)
+	<-w.ready
+}
+
+// readyWriter discards the log and tells when the gateway is running, which
+// also orders the startup of gateway before the tests for the race detector.
+type readyWriter struct {
+	once  sync.Once
+	ready chan struct{}
+}
+
+func (w *readyWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("Gateway running")) {
+		w.once.Do(func() {
+			close(w.ready)
+		})
+	}
+	return len(p), nil
 }
 
 func RandBytes(n int) []byte {
@@ -68,10 +106,25 @@ func Test_Fatals(t *testing.T) {
 		defer func() {
 			err := recover()
 			utest.NotNilNow(t, err)
-			utest.Assert(t, strings.Contains(err.(string), "Setup listener failed"))
+			utest.Assert(t, strings.Contains(err.(string), `Invalid gateway address "abc"`))
 		}()
 		main()
 	}()
+	for _, addr := range []string{"0.0.0.0:abc", "0.0.0.0:65536", "a b:80", ":-1"} {
+		cfgGatewayAddr = addr
+		func() {
+			defer func() {
+				err := recover()
+				utest.NotNilNow(t, err)
+				utest.Assert(t, strings.Contains(err.(string), "Invalid gateway address"), err)
+			}()
+			main()
+		}()
+	}
+	utest.IsNilNow(t, checkAddr(":0"))
+	utest.IsNilNow(t, checkAddr("[::1]:8080"))
+	utest.IsNilNow(t, checkAddr("localhost:8080"))
+	cfgGatewayAddr = "abc"
 
 	// bad gateway address with reuse port
 	cfgReusePort = true
@@ -129,6 +182,32 @@ func Test_BadReq3(t *testing.T) {
 	utest.EqualNow(t, string(code), string(codeBadReq))
 }
 
+func Test_BadReq4(t *testing.T) {
+	oldSecrets := cfgSecrets
+	defer func() {
+		cfgSecrets = oldSecrets
+	}()
+	var err error
+	cfgSecrets, err = parseSecrets("a=secret-a")
+	utest.IsNilNow(t, err)
+
+	encryptedEmpty, err := aes256cbc.EncryptString(string(cfgSecret), "")
+	utest.IsNilNow(t, err)
+
+	for _, line := range []string{"\n", "a:\n", encryptedEmpty + "\n"} {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(line))
+		utest.IsNilNow(t, err)
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(code), string(codeBadReq))
+	}
+}
+
 func Test_BadAddr(t *testing.T) {
 	conn, err := net.Dial("tcp", cfgGatewayAddr)
 	utest.IsNilNow(t, err)
@@ -277,6 +356,24 @@ func Test_Accept(t *testing.T) {
 	}()
 }
 
+func Test_AcceptBackoff(t *testing.T) {
+	oldDelay, oldMax := cfgAcceptDelay, cfgAcceptMax
+	defer func() {
+		cfgAcceptDelay, cfgAcceptMax = oldDelay, oldMax
+	}()
+
+	// 10ms, 20ms, 40ms and then capped at 50ms
+	cfgAcceptDelay = uint(10 * time.Millisecond)
+	cfgAcceptMax = uint(50 * time.Millisecond)
+	begin := time.Now()
+	_, err := accept(&TestListener{
+		6, TestError{false, true},
+	})
+	utest.IsNilNow(t, err)
+	d := time.Since(begin)
+	utest.Assert(t, d >= 220*time.Millisecond && d < 500*time.Millisecond, d)
+}
+
 type TestReadWriteCloser struct {
 	closed bool
 }
@@ -344,17 +441,3750 @@ func Test_Transfer(t *testing.T) {
 	}
 }
 
-var testBufPool1 = sync.Pool{
-	New: func() interface{} {
-		return make([]byte, 64)
-	},
+func Test_BufferSizeWarning(t *testing.T) {
+	oldSize := cfgBufferSize
+	setGlobals(t, func() {
+		cfgBufferSize = miniBufferSize
+	})
+	defer setGlobals(t, func() {
+		cfgBufferSize = oldSize
+	})
+
+	// too few reads to judge
+	utest.Assert(t, !checkBufferSize(miniBufferSize*10, 10))
+
+	// reads are much smaller than the buffer
+	utest.Assert(t, !checkBufferSize(miniBufferSize*bufferWarnReads/4, bufferWarnReads))
+
+	// every read fills the buffer
+	utest.Assert(t, checkBufferSize(miniBufferSize*bufferWarnReads, bufferWarnReads))
+
+	// only warn once
+	utest.Assert(t, !checkBufferSize(miniBufferSize*bufferWarnReads, bufferWarnReads))
 }
 
-var testBufPool2 = sync.Pool{
-	New: func() interface{} {
-		buf := make([]byte, 64)
-		return &buf
-	},
+// sizeConn records the buffer sizes it is read with.
+type sizeConn struct {
+	net.Conn
+	mu    sync.Mutex
+	sizes map[int]int
+}
+
+func (c *sizeConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	c.sizes[len(p)]++
+	c.mu.Unlock()
+	return c.Conn.Read(p)
+}
+
+func (c *sizeConn) readSizes() map[int]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sizes := make(map[int]int)
+	for size, n := range c.sizes {
+		sizes[size] = n
+	}
+	return sizes
+}
+
+func Test_CopyBuffer(t *testing.T) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer lsn.Close()
+	pair := func() (net.Conn, net.Conn) {
+		client, err := net.Dial("tcp", lsn.Addr().String())
+		utest.IsNilNow(t, err)
+		server, err := lsn.Accept()
+		utest.IsNilNow(t, err)
+		return client, server
+	}
+	srcClient, srcServer := pair()
+	defer srcServer.Close()
+	dstClient, dstServer := pair()
+	defer dstClient.Close()
+
+	data := make([]byte, 256*1024)
+	go func() {
+		srcClient.Write(data)
+		srcClient.Close()
+	}()
+	go func() {
+		io.Copy(ioutil.Discard, dstServer)
+		dstServer.Close()
+	}()
+
+	// a wrapped connection can't be spliced, the buffer does the copy
+	src := &sizeConn{Conn: srcServer, sizes: make(map[int]int)}
+	n, err := copy(dstClient, src, int(cfgBufferSize))
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, n, int64(len(data)))
+	sizes := src.readSizes()
+	utest.Assert(t, len(sizes) != 0)
+	for size := range sizes {
+		utest.EqualNow(t, size, int(cfgBufferSize))
+	}
+}
+
+func Test_ClampBuffer(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	clamped := func(size uint) uint {
+		clampBuffer("Buffer size", &size)
+		return size
+	}
+	utest.EqualNow(t, clamped(64*1024), uint(64*1024))
+	utest.EqualNow(t, clamped(maxBufferSize), uint(maxBufferSize))
+	utest.EqualNow(t, buf.String(), "")
+
+	utest.EqualNow(t, clamped(1<<30), uint(maxBufferSize))
+	utest.Assert(t, strings.Contains(buf.String(), fmt.Sprintf("Buffer size %d is larger than %d, clamped", 1<<30, maxBufferSize)), buf.String())
+}
+
+func Test_DialTimeoutHint(t *testing.T) {
+	oldTimeout := cfgDialTimeout
+	defer func() {
+		cfgDialTimeout = oldTimeout
+		dialAttempts, dialTimeouts = 0, 0
+	}()
+
+	// long timeout is trusted
+	cfgDialTimeout = uint(5 * time.Second)
+	for i := 0; i < dialHintDials; i++ {
+		utest.Assert(t, !checkDialTimeout(TestError{timeout: true}))
+	}
+
+	cfgDialTimeout = uint(time.Second)
+	dialAttempts, dialTimeouts = 0, 0
+	dialHintOnce = sync.Once{}
+
+	// timeouts are rare
+	for i := 0; i < dialHintDials; i++ {
+		utest.Assert(t, !checkDialTimeout(nil))
+	}
+
+	// most dials time out
+	warned := false
+	for i := 0; i < dialHintDials*2 && !warned; i++ {
+		warned = checkDialTimeout(TestError{timeout: true})
+	}
+	utest.Assert(t, warned)
+
+	// only hint once
+	utest.Assert(t, !checkDialTimeout(TestError{timeout: true}))
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func Test_Pipeline(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	// handshake and data in one packet, more data before reading the code
+	_, err = conn.Write([]byte(encryptedAddr + "\nabc"))
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte("def"))
+	utest.IsNilNow(t, err)
+
+	buf := make([]byte, 9)
+	_, err = io.ReadFull(conn, buf)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(buf[:3]), string(codeOK))
+	utest.EqualNow(t, string(buf[3:]), "abcdef")
+}
+
+func dialTarget(t *testing.T, target string) (net.Conn, string) {
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), target)
+	utest.IsNilNow(t, err)
+
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	return conn, string(code)
+}
+
+// setGlobals waits for the connections accepted by the gateways to close,
+// then calls set to change the globals they read. Counting a connection in
+// handling after that orders set before the connections accepted later, so
+// neither the tunnels of earlier tests nor the later ones race with it.
+func setGlobals(t *testing.T, set func()) {
+	for i := 0; handling.count() != 0; i++ {
+		if i == 300 {
+			t.Fatalf("%d connections are not closed", handling.count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	set()
+	handling.acquire(0)
+	handling.release()
+}
+
+func Test_DefaultPort(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	// without default port
+	conn, code := dialTarget(t, "127.0.0.1")
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialErr))
+
+	// with default port
+	oldPort := cfgDefaultPort
+	defer func() {
+		cfgDefaultPort = oldPort
+	}()
+	p, err := strconv.Atoi(port)
+	utest.IsNilNow(t, err)
+	cfgDefaultPort = uint(p)
+
+	conn, code = dialTarget(t, "127.0.0.1")
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	conn, code = dialTarget(t, "[127.0.0.1]")
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// explicit port is kept
+	conn, code = dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	addr, err := defaultPort("::1")
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, addr, "[::1]:"+port)
+}
+
+func Test_RateLimit(t *testing.T) {
+	limited := startEchoServer(t)
+	defer limited.Close()
+	unlimited := startEchoServer(t)
+	defer unlimited.Close()
+
+	oldLimits := cfgRateLimits
+	defer func() {
+		cfgRateLimits = oldLimits
+	}()
+	var err error
+	cfgRateLimits, err = parseRateLimits(limited.Addr().String() + "=16384")
+	utest.IsNilNow(t, err)
+
+	_, err = parseRateLimits("127.0.0.1:80")
+	utest.NotNilNow(t, err)
+	_, err = parseRateLimits("127.0.0.1:80=0")
+	utest.NotNilNow(t, err)
+	_, err = parseRateLimits("[127.0.0.1:80=1024")
+	utest.NotNilNow(t, err)
+
+	transfer := func(target string) time.Duration {
+		conn, code := dialTarget(t, target)
+		defer conn.Close()
+		utest.EqualNow(t, code, string(codeOK))
+
+		start := time.Now()
+		for i := 0; i < 2; i++ {
+			b1 := make([]byte, 8192)
+			_, err := conn.Write(b1)
+			utest.IsNilNow(t, err)
+			b2 := make([]byte, len(b1))
+			_, err = io.ReadFull(conn, b2)
+			utest.IsNilNow(t, err)
+		}
+		return time.Since(start)
+	}
+
+	utest.Assert(t, transfer(limited.Addr().String()) > 500*time.Millisecond)
+	utest.Assert(t, transfer(unlimited.Addr().String()) < 500*time.Millisecond)
+}
+
+func Test_Secrets(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldSecrets := cfgSecrets
+	defer func() {
+		cfgSecrets = oldSecrets
+	}()
+	var err error
+	cfgSecrets, err = parseSecrets("a=secret-a, b=secret-b")
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, keyIDs(), "a,b")
+
+	for _, bad := range []string{"a", "=x", "a=", "a=1,a=2", "0123456789abcdefg=x"} {
+		_, err = parseSecrets(bad)
+		utest.NotNilNow(t, err)
+	}
+
+	handshake := func(prefix, secret string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+
+		encryptedAddr, err := aes256cbc.EncryptString(secret, listener.Addr().String())
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(prefix + encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return string(code)
+	}
+
+	utest.EqualNow(t, handshake("a:", "secret-a"), string(codeOK))
+	utest.EqualNow(t, handshake("b:", "secret-b"), string(codeOK))
+	utest.EqualNow(t, handshake("", string(cfgSecret)), string(codeOK))
+	utest.EqualNow(t, handshake("c:", "secret-a"), string(codeBadAddr))
+
+	// decrypting with a wrong secret may pass the padding check by chance
+	utest.Assert(t, handshake("b:", "secret-a") != string(codeOK))
+	utest.Assert(t, handshake("a:", string(cfgSecret)) != string(codeOK))
+}
+
+func Test_BreakGlass(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	buf, restore := captureLog()
+	defer restore()
+
+	_, err := parseSecrets("breakglass=x")
+	utest.NotNilNow(t, err)
+
+	oldBreakGlass := cfgBreakGlass
+	defer func() {
+		cfgBreakGlass = oldBreakGlass
+	}()
+	uses := breakGlassUses.Value()
+
+	handshake := func(secret, target string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+		encryptedAddr, err := aes256cbc.EncryptString(secret, target)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte("breakglass:" + encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+		code, _ := ioutil.ReadAll(conn)
+		if len(code) > 3 {
+			code = code[:3]
+		}
+		return string(code)
+	}
+
+	// refused when not configured
+	utest.EqualNow(t, handshake("emergency", listener.Addr().String()), string(codeBadAddr))
+	utest.EqualNow(t, breakGlassUses.Value(), uses)
+
+	cfgBreakGlass = []byte("emergency")
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString("emergency", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte("breakglass:" + encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	reply := make([]byte, 3)
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), string(codeOK))
+	utest.EqualNow(t, breakGlassUses.Value(), uses+1)
+	utest.Assert(t, strings.Contains(buf.String(), "AUDIT break-glass handshake from "+conn.LocalAddr().String()+" to "+listener.Addr().String()+"\n"), buf.String())
+
+	// audited even when a later check refuses the handshake, without the
+	// credentials
+	utest.EqualNow(t, handshake("emergency", "u:p@"+listener.Addr().String()+"?ttl=x"), string(codeBadAddr))
+	utest.EqualNow(t, breakGlassUses.Value(), uses+2)
+	utest.EqualNow(t, strings.Count(buf.String(), "AUDIT break-glass handshake from "), 2)
+	utest.Assert(t, !strings.Contains(buf.String(), "u:p@"), buf.String())
+
+	// other passphrases are not accepted by the key ID
+	utest.Assert(t, handshake(string(cfgSecret), listener.Addr().String()) != string(codeOK))
+}
+
+func Test_HostRegex(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	_, err = compileHostRegex("[")
+	utest.NotNilNow(t, err)
+
+	oldHostRe := cfgHostRe
+	defer func() {
+		cfgHostRe = oldHostRe
+	}()
+	cfgHostRe, err = compileHostRegex(`127\.0\.0\.\d+`)
+	utest.IsNilNow(t, err)
+
+	rejected := mapValue(rejections, "hostregex")
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	conn, code = dialTarget(t, "localhost:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeForbidden))
+	utest.EqualNow(t, mapValue(rejections, "hostregex"), rejected+1)
+
+	// the whole hostname must match
+	cfgHostRe, err = compileHostRegex(`127\.0`)
+	utest.IsNilNow(t, err)
+	conn, code = dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeForbidden))
+}
+
+func Test_LocalOnly(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	oldLocalOnly, oldLookupHost, oldDial := cfgLocalOnly, lookupHost, dialTimeout
+	defer setGlobals(t, func() {
+		cfgLocalOnly, lookupHost, dialTimeout = oldLocalOnly, oldLookupHost, oldDial
+	})
+	setGlobals(t, func() {
+		cfgLocalOnly = true
+		lookupHost = func(ctx context.Context, host string) ([]string, error) {
+			switch host {
+			case "local.test", "rebind.test":
+				return []string{"127.0.0.1", "::1"}, nil
+			case "mixed.test":
+				return []string{"127.0.0.1", "10.0.0.1"}, nil
+			}
+			return nil, errors.New("no such host")
+		}
+		// rebind.test resolves to an external address when dialed
+		dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+			if !strings.HasPrefix(address, "rebind.test:") {
+				return net.DialTimeout(network, address, timeout)
+			}
+			conn, err := net.DialTimeout(network, listener.Addr().String(), timeout)
+			if err != nil {
+				return nil, err
+			}
+			return &remoteConn{Conn: conn, remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}}, nil
+		}
+	})
+
+	rejected := mapValue(rejections, "localonly")
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// external targets are never dialed
+	for _, target := range []string{"10.0.0.1:" + port, "[2001:db8::1]:" + port, "mixed.test:" + port, "unknown.test:" + port} {
+		conn, code = dialTarget(t, target)
+		conn.Close()
+		utest.EqualNow(t, code, string(codeForbidden))
+	}
+	utest.EqualNow(t, mapValue(rejections, "localonly"), rejected+4)
+
+	// checked again after dialed
+	conn, code = dialTarget(t, "rebind.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeForbidden))
+	utest.EqualNow(t, mapValue(rejections, "localonly"), rejected+5)
+
+	utest.Assert(t, loopbackTarget("local.test:"+port))
+	utest.Assert(t, loopbackTarget("[::1]:"+port))
+	setGlobals(t, func() {
+		cfgLocalOnly = false
+	})
+	utest.Assert(t, loopbackTarget("10.0.0.1:"+port))
+}
+
+// remoteConn reports another remote address than it's connected to.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func Test_AllowExact(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	for _, s := range []string{"db", "db:", ":3306", "*:80,db:3306"} {
+		_, err = parseExactTargets(s)
+		utest.NotNilNow(t, err)
+	}
+	targets, err := parseExactTargets(" , ")
+	utest.IsNilNow(t, err)
+	utest.Assert(t, targets == nil, targets)
+
+	oldExact := cfgExactList
+	defer func() {
+		cfgExactList = oldExact
+	}()
+	cfgExactList, err = parseExactTargets(listener.Addr().String() + ", DB.internal:3306")
+	utest.IsNilNow(t, err)
+
+	rejected := mapValue(rejections, "allowexact")
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// near misses are rejected
+	for _, target := range []string{"localhost:" + port, "127.0.0.2:" + port, "127.0.0.1:1" + port, "127.0.0.1"} {
+		conn, code = dialTarget(t, target)
+		conn.Close()
+		utest.EqualNow(t, code, string(codeForbidden))
+	}
+	utest.EqualNow(t, mapValue(rejections, "allowexact"), rejected+4)
+
+	utest.Assert(t, exactTarget("db.internal:3306"))
+	utest.Assert(t, !exactTarget("db.internal:3307"))
+	utest.Assert(t, !exactTarget("db.internal.:3306"))
+}
+
+func Test_AllowList(t *testing.T) {
+	listener1 := startEchoServer(t)
+	defer listener1.Close()
+	listener2 := startEchoServer(t)
+	defer listener2.Close()
+
+	oldSecrets, oldAllow := cfgSecrets, cfgAllowList
+	defer func() {
+		cfgSecrets, cfgAllowList = oldSecrets, oldAllow
+	}()
+	var err error
+	cfgSecrets, err = parseSecrets("a=secret-a,b=secret-b,c=secret-c")
+	utest.IsNilNow(t, err)
+	cfgAllowList, err = parseAllowList("a=" + listener1.Addr().String() + ",b=" + listener2.Addr().String() + ",b=10.0.0.*:*")
+	utest.IsNilNow(t, err)
+
+	_, err = parseAllowList("a")
+	utest.NotNilNow(t, err)
+	_, err = parseAllowList("a=[")
+	utest.NotNilNow(t, err)
+
+	handshake := func(id, target string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+
+		encryptedAddr, err := aes256cbc.EncryptString("secret-"+id, target)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(id + ":" + encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return string(code)
+	}
+
+	rejected := mapValue(rejections, "allow")
+	utest.EqualNow(t, handshake("a", listener1.Addr().String()), string(codeOK))
+	utest.EqualNow(t, handshake("a", listener2.Addr().String()), string(codeForbidden))
+	utest.EqualNow(t, mapValue(rejections, "allow"), rejected+1)
+	utest.EqualNow(t, handshake("b", listener2.Addr().String()), string(codeOK))
+	utest.EqualNow(t, handshake("b", listener1.Addr().String()), string(codeForbidden))
+
+	// tenant without rules
+	utest.EqualNow(t, handshake("c", listener1.Addr().String()), string(codeOK))
+	utest.EqualNow(t, handshake("c", listener2.Addr().String()), string(codeOK))
+}
+
+func Test_MappedTarget(t *testing.T) {
+	utest.EqualNow(t, normalizeTarget("[::ffff:192.0.2.1]:80"), "192.0.2.1:80")
+	utest.EqualNow(t, normalizeTarget("[::ffff:c000:201]:80"), "192.0.2.1:80")
+	utest.EqualNow(t, normalizeTarget("[2001:db8::1]:80"), "[2001:db8::1]:80")
+	utest.EqualNow(t, normalizeTarget("192.0.2.1:80"), "192.0.2.1:80")
+	utest.EqualNow(t, normalizeTarget("example.com:80"), "example.com:80")
+
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	oldSecrets, oldAllow := cfgSecrets, cfgAllowList
+	defer func() {
+		cfgSecrets, cfgAllowList = oldSecrets, oldAllow
+	}()
+	cfgSecrets, err = parseSecrets("a=secret-a,b=secret-b")
+	utest.IsNilNow(t, err)
+	cfgAllowList, err = parseAllowList("a=127.0.0.1:" + port + `,b=\[::ffff:127.0.0.1\]:` + port)
+	utest.IsNilNow(t, err)
+
+	handshake := func(id, target string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+
+		encryptedAddr, err := aes256cbc.EncryptString("secret-"+id, target)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(id + ":" + encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return string(code)
+	}
+
+	// mapped target matches IPv4 rule and the other way round
+	utest.EqualNow(t, handshake("a", "[::ffff:127.0.0.1]:"+port), string(codeOK))
+	utest.EqualNow(t, handshake("a", "127.0.0.1:"+port), string(codeOK))
+	utest.EqualNow(t, handshake("b", "127.0.0.1:"+port), string(codeOK))
+	utest.EqualNow(t, handshake("b", "[::ffff:127.0.0.1]:"+port), string(codeOK))
+	utest.EqualNow(t, handshake("a", "[::ffff:127.0.0.2]:"+port), string(codeForbidden))
+}
+
+func Test_TenantQuota(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldSecrets, oldTenants := cfgSecrets, cfgTenants
+	defer func() {
+		cfgSecrets, cfgTenants = oldSecrets, oldTenants
+	}()
+	var err error
+	cfgSecrets, err = parseSecrets("a=secret-a,b=secret-b")
+	utest.IsNilNow(t, err)
+	conns, err := parseQuotas("a=1")
+	utest.IsNilNow(t, err)
+	cfgTenants = newTenants(conns, nil)
+
+	_, err = parseQuotas("c=1")
+	utest.NotNilNow(t, err)
+	_, err = parseQuotas("a=0")
+	utest.NotNilNow(t, err)
+
+	handshake := func(id string) (net.Conn, string) {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+
+		encryptedAddr, err := aes256cbc.EncryptString("secret-"+id, listener.Addr().String())
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(id + ":" + encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return conn, string(code)
+	}
+
+	rejected := mapValue(rejections, "tenant")
+	conn1, code := handshake("a")
+	utest.EqualNow(t, code, string(codeOK))
+	conn2, code := handshake("a")
+	conn2.Close()
+	utest.EqualNow(t, code, string(codeTooBusy))
+	utest.EqualNow(t, mapValue(rejections, "tenant"), rejected+1)
+
+	// other tenant is unaffected
+	for i := 0; i < 3; i++ {
+		conn, code := handshake("b")
+		defer conn.Close()
+		utest.EqualNow(t, code, string(codeOK))
+	}
+
+	_, err = conn1.Write([]byte("abc"))
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn1, make([]byte, 3))
+	utest.IsNilNow(t, err)
+
+	stats := tenantStats().(map[string]map[string]int64)
+	utest.EqualNow(t, stats["a"]["conns"], int64(1))
+	utest.EqualNow(t, stats["a"]["bytes"], int64(6))
+	utest.EqualNow(t, stats["b"]["conns"], int64(3))
+
+	// slot is released after tunnel closed
+	conn1.Close()
+	time.Sleep(100 * time.Millisecond)
+	utest.EqualNow(t, cfgTenants["a"].conns.count(), int64(0))
+	conn1, code = handshake("a")
+	conn1.Close()
+	utest.EqualNow(t, code, string(codeOK))
+}
+
+func Test_Probe(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldProbe := cfgProbe
+	defer setGlobals(t, func() {
+		cfgProbe = oldProbe
+	})
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	// returns the server side of a connection whose client sent data and quit
+	clientGone := func(data string) net.Conn {
+		lsn, err := net.Listen("tcp", "127.0.0.1:0")
+		utest.IsNilNow(t, err)
+		defer lsn.Close()
+
+		client, err := net.Dial("tcp", lsn.Addr().String())
+		utest.IsNilNow(t, err)
+		_, err = client.Write([]byte(data))
+		utest.IsNilNow(t, err)
+		client.Close()
+
+		conn, err := lsn.Accept()
+		utest.IsNilNow(t, err)
+		return conn
+	}
+
+	// without probe
+	setGlobals(t, func() {
+		cfgProbe = 0
+	})
+	conn := clientGone(encryptedAddr + "\n")
+	agent := handshake(conn, &tunnel{})
+	conn.Close()
+	utest.NotNilNow(t, agent)
+	agent.Close()
+
+	// with probe
+	cfgProbe = uint(100 * time.Millisecond)
+	conn = clientGone(encryptedAddr + "\n")
+	agent = handshake(conn, &tunnel{})
+	conn.Close()
+	utest.IsNilNow(t, agent)
+
+	// alive client
+	conn, err = net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+	_, err = conn.Write([]byte("abc"))
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), "abc")
+}
+
+func Test_Maintenance(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	conn1, code := dialTarget(t, listener.Addr().String())
+	defer conn1.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	cfgMaintenance = true
+	defer func() {
+		cfgMaintenance = false
+	}()
+
+	conn2, code := dialTarget(t, listener.Addr().String())
+	conn2.Close()
+	utest.EqualNow(t, code, string(codeMaintenance))
+
+	// existing tunnel stays up
+	_, err := conn1.Write([]byte("abc"))
+	utest.IsNilNow(t, err)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(conn1, buf)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(buf), "abc")
+}
+
+func Test_CloseReason(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	count := func(reason string) int64 {
+		if v, ok := closeStats.Get(reason).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	tunnel := func(reset bool) {
+		conn, code := dialTarget(t, listener.Addr().String())
+		defer conn.Close()
+		utest.EqualNow(t, code, string(codeOK))
+
+		agent, err := listener.Accept()
+		utest.IsNilNow(t, err)
+		if reset {
+			agent.(*net.TCPConn).SetLinger(0)
+		}
+		agent.Close()
+
+		_, err = conn.Read(make([]byte, 1))
+		utest.NotNilNow(t, err)
+	}
+
+	// tunnels of other tests may close in the meantime
+	reset := count("reset")
+	tunnel(true)
+	utest.EqualNow(t, count("reset"), reset+1)
+
+	clean := count("clean")
+	tunnel(false)
+	utest.EqualNow(t, count("reset"), reset+1)
+	utest.Assert(t, count("clean") > clean)
+
+	utest.EqualNow(t, closeReason(nil), "clean")
+	utest.EqualNow(t, closeReason(&net.OpError{Err: os.NewSyscallError("read", syscall.ECONNRESET)}), "reset")
+	utest.EqualNow(t, closeReason(io.ErrUnexpectedEOF), "error")
+	utest.EqualNow(t, closeReason(TestError{true, false}), "ttl")
+}
+
+// deadConn fails reads like a peer found dead by keepalive.
+type deadConn struct {
+	net.Conn
+}
+
+func (c deadConn) Read(p []byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ETIMEDOUT)}
+}
+
+func Test_KeepaliveReason(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldDial := dialTimeout
+	defer func() {
+		dialTimeout = oldDial
+	}()
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return deadConn{conn}, nil
+	}
+
+	buf, restore := captureAccessLog(t)
+	defer restore()
+	keepalive := mapValue(closeStats, "keepalive")
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	utest.EqualNow(t, code, string(codeOK))
+	ioutil.ReadAll(conn)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	fields := accessLogFields(buf, "client="+conn.LocalAddr().String())
+	utest.NotNilNow(t, fields)
+	utest.EqualNow(t, fields["reason"], "keepalive")
+	utest.EqualNow(t, mapValue(closeStats, "keepalive"), keepalive+1)
+}
+
+func Test_Mirror(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	tap, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer tap.Close()
+
+	oldMirror := cfgMirror
+	defer func() {
+		cfgMirror = oldMirror
+	}()
+	cfgMirror = tap.Addr().String()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\nabc"))
+	utest.IsNilNow(t, err)
+
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(conn, buf)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(buf), string(codeOK)+"abc")
+
+	_, err = conn.Write([]byte("def"))
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn, buf[:3])
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(buf[:3]), "def")
+	conn.Close()
+
+	tapConn, err := tap.Accept()
+	utest.IsNilNow(t, err)
+	defer tapConn.Close()
+	tapConn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := ioutil.ReadAll(tapConn)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(data), "abcdef")
+
+	// tap never reads, the tunnel is not slowed down
+	conn, code := dialTarget(t, listener.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	go func() {
+		b := make([]byte, 64*1024)
+		for i := 0; i < 256; i++ {
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, make([]byte, 256*64*1024))
+	utest.IsNilNow(t, err)
+
+	// tap is unreachable
+	tap.Close()
+	conn, code = dialTarget(t, listener.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	_, err = conn.Write([]byte("abc"))
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn, buf[:3])
+	utest.IsNilNow(t, err)
+}
+
+func Test_TTL(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldTTL := cfgMaxTTL
+	defer func() {
+		cfgMaxTTL = oldTTL
+	}()
+	cfgMaxTTL = 0
+
+	lifetime := func(target string) time.Duration {
+		conn, code := dialTarget(t, target)
+		defer conn.Close()
+		utest.EqualNow(t, code, string(codeOK))
+
+		start := time.Now()
+		_, err := conn.Write([]byte("abc"))
+		utest.IsNilNow(t, err)
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err = io.ReadFull(conn, make([]byte, 3))
+		utest.IsNilNow(t, err)
+		_, err = conn.Read(make([]byte, 1))
+		utest.NotNilNow(t, err)
+		return time.Since(start)
+	}
+
+	// client ttl is honored
+	timeouts := mapValue(timeoutStats, "ttl")
+	d := lifetime(listener.Addr().String() + "?ttl=1")
+	utest.Assert(t, d > 800*time.Millisecond && d < 2*time.Second, d)
+
+	// capped by server
+	cfgMaxTTL = uint(200 * time.Millisecond)
+	d = lifetime(listener.Addr().String() + "?ttl=60")
+	utest.Assert(t, d < 800*time.Millisecond, d)
+	utest.EqualNow(t, mapValue(timeoutStats, "ttl"), timeouts+2)
+
+	conn, code := dialTarget(t, listener.Addr().String()+"?ttl=abc")
+	conn.Close()
+	utest.EqualNow(t, code, string(codeBadAddr))
+	conn, code = dialTarget(t, listener.Addr().String()+"?ttl=0")
+	conn.Close()
+	utest.EqualNow(t, code, string(codeBadAddr))
+}
+
+func Test_CheckBase64(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	utest.Assert(t, isBase64([]byte("QUJDRA==")))
+	utest.Assert(t, isBase64([]byte("QUJDREVG")))
+	utest.Assert(t, isBase64([]byte("a+/9")))
+	utest.Assert(t, !isBase64([]byte("QUJDRA=")))
+	utest.Assert(t, !isBase64([]byte("QU=DRA==")))
+	utest.Assert(t, !isBase64([]byte("QUJD===A")))
+	utest.Assert(t, !isBase64([]byte("QUJ-RA==")))
+	utest.Assert(t, !isBase64([]byte("GET / HTTP/1.1")))
+
+	oldCheck := cfgCheckBase64
+	defer func() {
+		cfgCheckBase64 = oldCheck
+	}()
+	cfgCheckBase64 = true
+
+	handshake := func(line string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(line + "\n"))
+		utest.IsNilNow(t, err)
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return string(code)
+	}
+
+	// rejected before decrypting
+	utest.EqualNow(t, handshake("GET / HTTP/1.1"), string(codeBadBase64))
+	utest.EqualNow(t, handshake("QUJDRA="), string(codeBadBase64))
+
+	// base64 but not the ciphertext
+	utest.EqualNow(t, handshake("QUJDRA=="), string(codeBadAddr))
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+}
+
+func Test_FixedLen(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	oldLen := cfgFixedLen
+	defer func() {
+		cfgFixedLen = oldLen
+	}()
+	cfgFixedLen = uint(len(encryptedAddr))
+
+	// data right after the handshake is forwarded
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(encryptedAddr + "ping"))
+	utest.IsNilNow(t, err)
+	reply := make([]byte, 7)
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), string(codeOK)+"ping")
+
+	// too short
+	conn2, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn2.Close()
+	_, err = conn2.Write([]byte(encryptedAddr[:len(encryptedAddr)-1]))
+	utest.IsNilNow(t, err)
+	conn2.(*net.TCPConn).CloseWrite()
+	code, _ := ioutil.ReadAll(conn2)
+	utest.EqualNow(t, string(code), string(codeBadReq))
+}
+
+func Test_UserInfo(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldUserInfo := cfgUserInfo
+	defer func() {
+		cfgUserInfo = oldUserInfo
+	}()
+	logs, restore := captureLog()
+	defer restore()
+
+	cfgUserInfo = "strip"
+	conn, code := dialTarget(t, "user:pass@"+listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	cfgUserInfo = "reject"
+	conn, code = dialTarget(t, "user:pass@"+listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeBadAddr))
+
+	utest.Assert(t, strings.Contains(logs.String(), "Strip credentials from target "+listener.Addr().String()), logs.String())
+	utest.Assert(t, strings.Contains(logs.String(), "Reject target "+listener.Addr().String()), logs.String())
+	utest.Assert(t, !strings.Contains(logs.String(), "pass"), logs.String())
+}
+
+func Test_NegotiatedBuffer(t *testing.T) {
+	oldMax, oldDial := cfgMaxBuffer, dialTimeout
+	defer setGlobals(t, func() {
+		cfgMaxBuffer, dialTimeout = oldMax, oldDial
+	})
+
+	size := func(s string) int {
+		n, err := bufferSize(url.Values{"buffer": {s}})
+		utest.IsNilNow(t, err)
+		return n
+	}
+
+	// not allowed
+	cfgMaxBuffer = 0
+	utest.EqualNow(t, size("65536"), int(cfgBufferSize))
+
+	// within server bounds
+	cfgMaxBuffer = 128 * 1024
+	utest.EqualNow(t, size("65536"), 65536)
+	utest.EqualNow(t, size("1048576"), 128*1024)
+	utest.EqualNow(t, size("1"), miniBufferSize)
+	_, err := bufferSize(url.Values{"buffer": {"abc"}})
+	utest.NotNilNow(t, err)
+
+	// the tunnel reads the target with the negotiated size
+	listener := startEchoServer(t)
+	defer listener.Close()
+	buf, restore := captureAccessLog(t)
+	defer restore()
+	var agent *sizeConn
+	setGlobals(t, func() {
+		dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+			conn, err := net.DialTimeout(network, address, timeout)
+			if err != nil {
+				return nil, err
+			}
+			agent = &sizeConn{Conn: conn, sizes: make(map[int]int)}
+			return agent, nil
+		}
+	})
+
+	conn, code := dialTarget(t, listener.Addr().String()+"?buffer=65536")
+	utest.EqualNow(t, code, string(codeOK))
+	_, err = conn.Write([]byte("ping"))
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	utest.IsNilNow(t, err)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	sizes := agent.readSizes()
+	utest.Assert(t, sizes[65536] != 0, sizes)
+	utest.EqualNow(t, len(sizes), 1)
+	fields := accessLogFields(buf, "client="+conn.LocalAddr().String())
+	utest.NotNilNow(t, fields)
+	utest.EqualNow(t, fields["buffer"], "65536")
+}
+
+func Test_Classify(t *testing.T) {
+	utest.EqualNow(t, classify([]byte("GET / HTTP/1.1\r\n")), "http")
+	utest.EqualNow(t, classify([]byte("PRI * HTTP/2.0\r\n")), "http2")
+	utest.EqualNow(t, classify([]byte{0x16, 0x03, 0x01, 0x02, 0x00}), "tls")
+	utest.EqualNow(t, classify([]byte("SSH-2.0-OpenSSH_8.9\r\n")), "ssh")
+	utest.EqualNow(t, classify([]byte("hello")), "unknown")
+	utest.EqualNow(t, classify(nil), "")
+
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldClassify := cfgClassify
+	defer func() {
+		cfgClassify = oldClassify
+	}()
+	cfgClassify = true
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	tunnel := func(data []byte) string {
+		conn, code := dialTarget(t, listener.Addr().String())
+		utest.EqualNow(t, code, string(codeOK))
+		_, err := conn.Write(data)
+		utest.IsNilNow(t, err)
+		_, err = io.ReadFull(conn, make([]byte, len(data)))
+		utest.IsNilNow(t, err)
+		conn.Close()
+		time.Sleep(100 * time.Millisecond)
+		fields := accessLogFields(buf, "client="+conn.LocalAddr().String())
+		utest.NotNilNow(t, fields)
+		return fields["protocol"]
+	}
+
+	httpTunnels := mapValue(protocolStats, "http")
+	utest.EqualNow(t, tunnel([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")), "http")
+	utest.EqualNow(t, mapValue(protocolStats, "http"), httpTunnels+1)
+
+	tlsTunnels := mapValue(protocolStats, "tls")
+	utest.EqualNow(t, tunnel([]byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01, 0x00}), "tls")
+	utest.EqualNow(t, mapValue(protocolStats, "tls"), tlsTunnels+1)
+}
+
+func Test_MaxSkew(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldSkew := cfgMaxSkew
+	defer func() {
+		cfgMaxSkew = oldSkew
+	}()
+	cfgMaxSkew = uint(time.Minute)
+
+	handshake := func(meta string) string {
+		conn, code := dialTarget(t, listener.Addr().String()+meta)
+		conn.Close()
+		return code
+	}
+	now := time.Now().Unix()
+	ts := func(offset int64) string {
+		return "?ts=" + strconv.FormatInt(now+offset, 10)
+	}
+
+	// in window
+	utest.EqualNow(t, handshake(ts(0)), string(codeOK))
+	utest.EqualNow(t, handshake(ts(-50)), string(codeOK))
+	utest.EqualNow(t, handshake(ts(50)), string(codeOK))
+
+	// too old, too new and missing
+	utest.EqualNow(t, handshake(ts(-120)), string(codeClockSkew))
+	utest.EqualNow(t, handshake(ts(120)), string(codeClockSkew))
+	utest.EqualNow(t, handshake(""), string(codeClockSkew))
+	utest.EqualNow(t, handshake("?ts=abc"), string(codeBadAddr))
+
+	// not required when disabled
+	cfgMaxSkew = 0
+	utest.EqualNow(t, handshake(""), string(codeOK))
+}
+
+type syncBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+// captureAccessLog redirects access log to a buffer until the returned
+// function is called.
+func captureAccessLog(t *testing.T) (*syncBuffer, func()) {
+	buf := new(syncBuffer)
+	oldLogger := accessLogger
+	setGlobals(t, func() {
+		accessLogger = log.New(buf, "", 0)
+	})
+	return buf, func() {
+		setGlobals(t, func() {
+			accessLogger = oldLogger
+		})
+	}
+}
+
+// accessLogFields returns the key=value fields of the line which contains s.
+func accessLogFields(buf *syncBuffer, s string) map[string]string {
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if !strings.Contains(line, s) {
+			continue
+		}
+		fields := make(map[string]string)
+		for _, field := range strings.Fields(line) {
+			if i := strings.Index(field, "="); i > 0 {
+				fields[field[:i]] = field[i+1:]
+			}
+		}
+		return fields
+	}
+	return nil
+}
+
+func Test_AccessLog(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	// slow handshake
+	_, err = conn.Write([]byte(encryptedAddr))
+	utest.IsNilNow(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = conn.Write([]byte("\n"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+
+	// transfer for a while
+	time.Sleep(200 * time.Millisecond)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	fields := accessLogFields(buf, "client="+conn.LocalAddr().String())
+	utest.NotNilNow(t, fields)
+	utest.EqualNow(t, fields["target"], listener.Addr().String())
+	utest.EqualNow(t, fields["reason"], "clean")
+
+	read, err := time.ParseDuration(fields["read"])
+	utest.IsNilNow(t, err)
+	utest.Assert(t, read >= 100*time.Millisecond && read < time.Second, read)
+	dial, err := time.ParseDuration(fields["dial"])
+	utest.IsNilNow(t, err)
+	utest.Assert(t, dial > 0 && dial < 100*time.Millisecond, dial)
+	transfer, err := time.ParseDuration(fields["transfer"])
+	utest.IsNilNow(t, err)
+	utest.Assert(t, transfer >= 200*time.Millisecond && transfer < time.Second, transfer)
+}
+
+func Test_AccessLogFormat(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	oldFormat := cfgLogFormat
+	defer func() {
+		cfgLogFormat = oldFormat
+	}()
+	cfgLogFormat = "logfmt"
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	utest.EqualNow(t, code, string(codeOK))
+	client := conn.LocalAddr().String()
+	conn.Close()
+	for i := 0; i < 100 && accessLogFields(buf, "client="+client+" ") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var line string
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(l, "client="+client+" ") {
+			line = l
+		}
+	}
+	utest.Assert(t, strings.HasPrefix(line, "time="), line)
+	fields := accessLogFields(buf, "client="+client+" ")
+	_, err := time.Parse(time.RFC3339, fields["time"])
+	utest.IsNilNow(t, err)
+	utest.Assert(t, strings.Contains(line, " client="+client+` key="" target=`+listener.Addr().String()+" "), line)
+	utest.EqualNow(t, fields["reason"], "clean")
+
+	// values are quoted only when needed
+	tun := &tunnel{client: "127.0.0.1:1", id: "a b", target: "db:3306", reason: "clean"}
+	utest.Assert(t, strings.Contains(tun.logfmt(), ` key="a b" target=db:3306 `), tun.logfmt())
+	utest.Assert(t, strings.HasPrefix(tun.String(), `client=127.0.0.1:1 key="a b" target=db:3306 read=0s`), tun.String())
+
+	// client given target can't forge fields or lines
+	tun.target = "db:3306 reason=clean\nclient=1.2.3.4"
+	for _, line := range []string{tun.String(), tun.logfmt()} {
+		utest.Assert(t, !strings.Contains(line, "\n"), line)
+		utest.Assert(t, strings.Contains(line, ` target="db:3306 reason=clean\nclient=1.2.3.4" `), line)
+	}
+}
+
+func Test_AccessLogBytes(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	// data pipelined in the handshake buffer
+	_, err = conn.Write([]byte(encryptedAddr + "\nhello"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+
+	_, err = conn.Write([]byte(" world"))
+	utest.IsNilNow(t, err)
+	echo := make([]byte, 11)
+	_, err = io.ReadFull(conn, echo)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(echo), "hello world")
+
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	fields := accessLogFields(buf, "client="+conn.LocalAddr().String())
+	utest.NotNilNow(t, fields)
+	utest.EqualNow(t, fields["sent"], "11")
+	utest.EqualNow(t, fields["received"], "11")
+}
+
+func Test_PipelineBurst(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	// the burst fills the handshake buffer, the line ends within it
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go conn.Write(append([]byte(encryptedAddr+"\n"), data...))
+	reply := make([]byte, 3+len(data))
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply[:3]), string(codeOK))
+	utest.Assert(t, bytes.Equal(reply[3:], data))
+}
+
+func Test_RemainOpaque(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	// a second handshake pipelined after the first is tunnel data
+	second := encryptedAddr + "\n"
+	_, err = conn.Write([]byte(encryptedAddr + "\n" + second))
+	utest.IsNilNow(t, err)
+	reply := make([]byte, 3+len(second))
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), string(codeOK)+second)
+}
+
+func Test_Ban(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldBans := bans
+	defer setGlobals(t, func() {
+		bans = oldBans
+	})
+	setGlobals(t, func() {
+		bans = newBanList(3, time.Minute, 200*time.Millisecond)
+	})
+
+	badHandshake := func() string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+		encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte("unknown:" + encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+		code, _ := ioutil.ReadAll(conn)
+		return string(code)
+	}
+
+	for i := 0; i < 3; i++ {
+		utest.EqualNow(t, badHandshake(), string(codeBadAddr))
+	}
+
+	// refused without code, even with the right secret
+	refused, rejected := bannedConns.Value(), mapValue(rejections, "ban")
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	conn.Write([]byte(encryptedAddr + "\n"))
+	code, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	utest.EqualNow(t, string(code), "")
+	utest.EqualNow(t, bannedConns.Value(), refused+1)
+	utest.EqualNow(t, mapValue(rejections, "ban"), rejected+1)
+
+	// cooldown passed
+	time.Sleep(300 * time.Millisecond)
+	conn, code2 := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code2, string(codeOK))
+}
+
+func Test_MaxTargets(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 3; i++ {
+		listener := startEchoServer(t)
+		defer listener.Close()
+		listeners = append(listeners, listener)
+	}
+
+	oldScans := scans
+	defer setGlobals(t, func() {
+		scans = oldScans
+	})
+	setGlobals(t, func() {
+		scans = newScanLimiter(2, 10*time.Second)
+	})
+	rejected := mapValue(rejections, "maxtargets")
+
+	reach := func(listener net.Listener) string {
+		conn, code := dialTarget(t, listener.Addr().String())
+		conn.Close()
+		return code
+	}
+	utest.EqualNow(t, reach(listeners[0]), string(codeOK))
+	utest.EqualNow(t, reach(listeners[1]), string(codeOK))
+
+	// the scanning client is blocked from new targets only
+	utest.EqualNow(t, reach(listeners[2]), string(codeScanning))
+	utest.EqualNow(t, reach(listeners[0]), string(codeOK))
+	utest.EqualNow(t, mapValue(rejections, "maxtargets"), rejected+1)
+
+	// other clients are not affected
+	utest.Assert(t, scans.allow("192.0.2.1", listeners[2].Addr().String()))
+
+	// targets out of the window are forgotten
+	l := newScanLimiter(1, time.Millisecond)
+	utest.Assert(t, l.allow("192.0.2.1", "db:3306"))
+	utest.Assert(t, !l.allow("192.0.2.1", "cache:6379"))
+	time.Sleep(10 * time.Millisecond)
+	utest.Assert(t, l.allow("192.0.2.1", "cache:6379"))
+}
+
+func Test_ScanSweep(t *testing.T) {
+	l := newScanLimiter(1, time.Millisecond)
+	for i := 0; i < 1024; i++ {
+		l.allow("192.0.2."+strconv.Itoa(i), "db:3306")
+	}
+	time.Sleep(10 * time.Millisecond)
+	utest.Assert(t, l.allow("198.51.100.1", "db:3306"))
+	utest.EqualNow(t, len(l.clients), 1)
+}
+
+func Test_DialRetries(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldRetry, oldDial := cfgDialRetry, dialTimeout
+	defer func() {
+		cfgDialRetry, dialTimeout = oldRetry, oldDial
+	}()
+	cfgDialRetry = 3
+
+	// the first attempt times out
+	var dials int32
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil, TestError{true, false}
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+
+	buf, restore := captureLog()
+	defer restore()
+	retries := dialRetries.Value()
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	utest.EqualNow(t, dialRetries.Value(), retries+1)
+	utest.Assert(t, strings.Contains(buf.String(), "Dial "+listener.Addr().String()+" succeeded after 2 attempts"), buf.String())
+}
+
+func Test_DenyReset(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldAllow, oldReset := cfgAllowList, cfgDenyReset
+	defer setGlobals(t, func() {
+		cfgAllowList, cfgDenyReset = oldAllow, oldReset
+	})
+	setGlobals(t, func() {
+		cfgAllowList = map[string][]string{"": {"10.0.0.1:*"}}
+	})
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeForbidden))
+
+	setGlobals(t, func() {
+		cfgDenyReset = true
+	})
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	n, err := conn.Read(make([]byte, 3))
+	utest.EqualNow(t, n, 0)
+	errno, ok := syscallErr(err)
+	utest.Assert(t, ok && errno == syscall.ECONNRESET, err)
+}
+
+func Test_CRLF(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	_, err = conn.Write([]byte(encryptedAddr + "\r\nping"))
+	utest.IsNilNow(t, err)
+	reply := make([]byte, 7)
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), string(codeOK)+"ping")
+}
+
+func Test_SummaryCSV(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	dir, err := ioutil.TempDir("", "gateway")
+	utest.IsNilNow(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "summary.csv")
+	_, err = openSummary(filepath.Join(dir, "missing", "summary.csv"))
+	utest.NotNilNow(t, err)
+
+	oldSummary := summary
+	defer setGlobals(t, func() {
+		summary = oldSummary
+	})
+	setGlobals(t, func() {
+		summary, err = openSummary(path)
+	})
+	utest.IsNilNow(t, err)
+
+	var clients []string
+	for i := 0; i < 3; i++ {
+		conn, code := dialTarget(t, listener.Addr().String())
+		utest.EqualNow(t, code, string(codeOK))
+		_, err := conn.Write([]byte("ping"))
+		utest.IsNilNow(t, err)
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		utest.IsNilNow(t, err)
+		clients = append(clients, conn.LocalAddr().String())
+		conn.Close()
+	}
+
+	// a failed handshake has a row too
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte("bad\n"))
+	utest.IsNilNow(t, err)
+	ioutil.ReadAll(conn)
+	failure := conn.LocalAddr().String()
+	conn.Close()
+
+	// the rows are written while running
+	read := func() [][]string {
+		f, err := os.Open(path)
+		utest.IsNilNow(t, err)
+		defer f.Close()
+		records, err := csv.NewReader(f).ReadAll()
+		utest.IsNilNow(t, err)
+		return records
+	}
+	records := read()
+	for i := 0; i < 300 && len(records) < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		records = read()
+	}
+	utest.EqualNow(t, len(records), 5)
+	utest.EqualNow(t, strings.Join(records[0], ","), strings.Join(summaryHeader, ","))
+
+	rows := make(map[string][]string)
+	for _, record := range records[1:] {
+		rows[record[0]] = record
+	}
+	for _, client := range clients {
+		row := rows[client]
+		utest.NotNilNow(t, row)
+		utest.EqualNow(t, row[2], listener.Addr().String())
+		utest.EqualNow(t, row[3], "4")
+		utest.EqualNow(t, row[4], "4")
+		utest.EqualNow(t, row[6], "clean")
+	}
+	row := rows[failure]
+	utest.NotNilNow(t, row)
+	utest.EqualNow(t, row[2], "")
+	utest.EqualNow(t, row[6], "handshake")
+	setGlobals(t, func() {
+		utest.IsNilNow(t, summary.close())
+	})
+}
+
+func Test_Verify(t *testing.T) {
+	oldVerify := cfgVerify
+	defer func() {
+		cfgVerify = oldVerify
+	}()
+	cfgVerify = uint(100 * time.Millisecond)
+
+	// accepts but never responds
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	conn, code := dialTarget(t, silent.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialTimeout))
+
+	// greeting forwarded after the succeed code
+	greeter, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer greeter.Close()
+	go func() {
+		for {
+			conn, err := greeter.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			go io.Copy(conn, conn)
+		}
+	}()
+	conn, code = dialTarget(t, greeter.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	greeting := make([]byte, 5)
+	_, err = io.ReadFull(conn, greeting)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(greeting), "hello")
+}
+
+// chunkWriter accepts at most size bytes every write.
+type chunkWriter struct {
+	bytes.Buffer
+	size, writes int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if len(p) > w.size {
+		p = p[:w.size]
+	}
+	return w.Buffer.Write(p)
+}
+
+func Test_WriteAll(t *testing.T) {
+	w := &chunkWriter{size: 3}
+	n, err := writeAll(w, []byte("remainder"))
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, n, 9)
+	utest.EqualNow(t, w.String(), "remainder")
+	utest.EqualNow(t, w.writes, 3)
+
+	w = &chunkWriter{size: 0}
+	_, err = writeAll(w, []byte("remainder"))
+	utest.EqualNow(t, err, io.ErrShortWrite)
+}
+
+func Test_GeoIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway")
+	utest.IsNilNow(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "geoip.txt")
+	err = ioutil.WriteFile(path, []byte("# test\n10.0.0.0/8 AA\n1.0.1.0/24 CN\n\n2001:db8::/32 BB\n"), 0644)
+	utest.IsNilNow(t, err)
+
+	db, err := loadGeoDB(path)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, db.lookup(net.ParseIP("1.0.1.200")), "CN")
+	utest.EqualNow(t, db.lookup(net.ParseIP("10.1.2.3")), "AA")
+	utest.EqualNow(t, db.lookup(net.ParseIP("2001:db8::1")), "BB")
+	utest.EqualNow(t, db.lookup(net.ParseIP("1.0.2.1")), "")
+
+	ioutil.WriteFile(path, []byte("1.0.1.0/33 CN\n"), 0644)
+	_, err = loadGeoDB(path)
+	utest.NotNilNow(t, err)
+
+	// label appears in access log and metrics
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldLookup := geoLookup
+	defer setGlobals(t, func() {
+		geoLookup = oldLookup
+	})
+	setGlobals(t, func() {
+		geoLookup = func(ip net.IP) string {
+			return "NZ"
+		}
+	})
+
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	utest.EqualNow(t, code, string(codeOK))
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	fields := accessLogFields(buf, "client="+conn.LocalAddr().String())
+	utest.NotNilNow(t, fields)
+	utest.EqualNow(t, fields["country"], "NZ")
+	utest.Assert(t, countryStats.Get("NZ") != nil)
+}
+
+func mapValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func Test_MemLimit(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldShedder := shedder
+	defer func() {
+		shedder = oldShedder
+	}()
+	shedder = newTunnelShedder(1 << 20)
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, code := dialTarget(t, listener.Addr().String())
+		defer conn.Close()
+		utest.EqualNow(t, code, string(codeOK))
+		conns = append(conns, conn)
+	}
+	count := func() int {
+		shedder.mu.Lock()
+		defer shedder.mu.Unlock()
+		return len(shedder.tunnels)
+	}
+	for i := 0; i < 100 && count() != 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	shed := mapValue(closeStats, "shed")
+	utest.EqualNow(t, shedder.check(1<<20), 0)
+	utest.EqualNow(t, shedder.check(2<<20), 1)
+
+	// the oldest tunnel is closed, others still work
+	conns[0].SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conns[0].Read(make([]byte, 1))
+	utest.Assert(t, err == io.EOF, err)
+	for _, conn := range conns[1:] {
+		_, err = conn.Write([]byte("ping"))
+		utest.IsNilNow(t, err)
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		utest.IsNilNow(t, err)
+	}
+	for i := 0; i < 100 && mapValue(closeStats, "shed") == shed; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.EqualNow(t, mapValue(closeStats, "shed"), shed+1)
+}
+
+func Test_KillSwitch(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldTunnels := liveTunnels
+	defer setGlobals(t, func() {
+		liveTunnels = oldTunnels
+		atomic.StoreInt32(&killSwitch, 0)
+	})
+	setGlobals(t, func() {
+		liveTunnels = newTunnelRegistry()
+	})
+	closes, rejected := mapValue(closeStats, "killswitch"), mapValue(rejections, "killswitch")
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, code := dialTarget(t, listener.Addr().String())
+		defer conn.Close()
+		utest.EqualNow(t, code, string(codeOK))
+		conns = append(conns, conn)
+	}
+	registered := func() int {
+		liveTunnels.mu.Lock()
+		defer liveTunnels.mu.Unlock()
+		return len(liveTunnels.tunnels)
+	}
+	for i := 0; i < 100 && registered() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	utest.EqualNow(t, liveTunnels.engage(), 2)
+
+	// all tunnels are closed
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		utest.Assert(t, err == io.EOF, err)
+	}
+	for i := 0; i < 100 && mapValue(closeStats, "killswitch") < closes+2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.EqualNow(t, mapValue(closeStats, "killswitch"), closes+2)
+
+	// new connections are refused without code
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	reply, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	utest.EqualNow(t, len(reply), 0)
+	utest.EqualNow(t, mapValue(rejections, "killswitch"), rejected+1)
+
+	// until cleared
+	liveTunnels.clear()
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+}
+
+func Test_NoData(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldNoData := cfgNoData
+	defer setGlobals(t, func() {
+		cfgNoData = oldNoData
+	})
+	setGlobals(t, func() {
+		cfgNoData = uint(100 * time.Millisecond)
+	})
+	reaped := mapValue(closeStats, "nodata")
+	timeouts := mapValue(timeoutStats, "nodata")
+
+	// silent tunnel is closed
+	conn, code := dialTarget(t, listener.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	begin := time.Now()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	utest.Assert(t, err == io.EOF, err)
+	utest.Assert(t, time.Since(begin) < 500*time.Millisecond, time.Since(begin))
+	for i := 0; i < 100 && mapValue(closeStats, "nodata") == reaped; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.EqualNow(t, mapValue(closeStats, "nodata"), reaped+1)
+	utest.EqualNow(t, mapValue(timeoutStats, "nodata"), timeouts+1)
+
+	// tunnel transferred data is kept
+	conn2, code := dialTarget(t, listener.Addr().String())
+	defer conn2.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	_, err = conn2.Write([]byte("ping"))
+	utest.IsNilNow(t, err)
+	time.Sleep(200 * time.Millisecond)
+	_, err = conn2.Write([]byte("pong"))
+	utest.IsNilNow(t, err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn2, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), "pingpong")
+}
+
+func Test_Stuck(t *testing.T) {
+	// target floods the client right after connected
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 64*1024)
+				for {
+					if _, err := conn.Write(b); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	oldNoData := cfgNoData
+	defer setGlobals(t, func() {
+		cfgNoData = oldNoData
+	})
+	setGlobals(t, func() {
+		cfgNoData = uint(100 * time.Millisecond)
+	})
+	stuck := mapValue(closeStats, "stuck")
+	timeouts := mapValue(timeoutStats, "stuck")
+
+	// client neither sends nor reads
+	conn, code := dialTarget(t, listener.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	for i := 0; i < 100 && mapValue(closeStats, "stuck") == stuck; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.EqualNow(t, mapValue(closeStats, "stuck"), stuck+1)
+	utest.EqualNow(t, mapValue(timeoutStats, "stuck"), timeouts+1)
+
+	// client reads what target sent
+	conn2, code := dialTarget(t, listener.Addr().String())
+	defer conn2.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	conn2.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+	n, err := io.Copy(ioutil.Discard, conn2)
+	utest.Assert(t, n > 0, n)
+	ne, ok := err.(net.Error)
+	utest.Assert(t, ok && ne.Timeout(), err)
+	utest.EqualNow(t, mapValue(closeStats, "stuck"), stuck+1)
+}
+
+func Test_MaxBytes(t *testing.T) {
+	// target replies much more than the client sends
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := io.ReadFull(conn, make([]byte, 100)); err != nil {
+					return
+				}
+				conn.Write(make([]byte, 950))
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	oldMaxBytes := cfgMaxBytes
+	defer func() {
+		cfgMaxBytes = oldMaxBytes
+	}()
+	cfgMaxBytes = 1000
+	closes := mapValue(closeStats, "maxbytes")
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// neither direction exceeds the cap alone
+	_, err = conn.Write(make([]byte, 100))
+	utest.IsNilNow(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := io.Copy(ioutil.Discard, conn)
+	utest.IsNilNow(t, err)
+	utest.Assert(t, n < 950, n)
+	for i := 0; i < 100 && mapValue(closeStats, "maxbytes") == closes; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.EqualNow(t, mapValue(closeStats, "maxbytes"), closes+1)
+}
+
+func Test_MaxPanics(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldMaxPanics, oldWindow, oldMode, oldCrash := cfgMaxPanics, cfgPanicWindow, cfgPanicMode, crash
+	defer func() {
+		cfgMaxPanics, cfgPanicWindow, cfgPanicMode, crash = oldMaxPanics, oldWindow, oldMode, oldCrash
+		atomic.StoreInt32(&panicking, 0)
+	}()
+	cfgMaxPanics = 3
+	cfgPanicWindow = uint(time.Minute)
+	var crashes int
+	crash = func(t string, args ...interface{}) {
+		crashes++
+	}
+	inject := func() {
+		defer func() {
+			if err := recover(); err != nil {
+				recovered(err)
+			}
+		}()
+		panic("injected")
+	}
+	panics := recoveredPanics.Value()
+
+	// crash for restart
+	cfgPanicMode = "crash"
+	panicBreaker.Lock()
+	panicBreaker.n = 0
+	panicBreaker.Unlock()
+	inject()
+	inject()
+	utest.EqualNow(t, crashes, 0)
+	inject()
+	utest.EqualNow(t, crashes, 1)
+	utest.EqualNow(t, recoveredPanics.Value(), panics+3)
+
+	// panics out of window are forgotten
+	cfgPanicMode = "maintenance"
+	panicBreaker.Lock()
+	panicBreaker.since = time.Now().Add(-2 * time.Minute)
+	panicBreaker.Unlock()
+	inject()
+	inject()
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// refuse new connections
+	inject()
+	conn, code = dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeMaintenance))
+	utest.EqualNow(t, crashes, 1)
+}
+
+func Test_BackendMax(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	oldBackendMax, oldDial := cfgBackendMax, dialTimeout
+	defer func() {
+		cfgBackendMax, dialTimeout = oldBackendMax, oldDial
+	}()
+	cfgBackendMax = 1
+
+	// both hostnames resolve to the echo server
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, listener.Addr().String(), timeout)
+	}
+
+	rejected := mapValue(rejections, "backend")
+	conn, code := dialTarget(t, "a.test:"+port)
+	utest.EqualNow(t, code, string(codeOK))
+	conn2, code := dialTarget(t, "b.test:"+port)
+	conn2.Close()
+	utest.EqualNow(t, code, string(codeTooBusy))
+	utest.EqualNow(t, mapValue(rejections, "backend"), rejected+1)
+
+	// slot is released when the tunnel closed
+	conn.Close()
+	for i := 0; i < 100; i++ {
+		conn2, code = dialTarget(t, "b.test:"+port)
+		conn2.Close()
+		if code == string(codeOK) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.EqualNow(t, code, string(codeOK))
+}
+
+func Test_RemoteAddr(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	logged := func(target string) map[string]string {
+		conn, code := dialTarget(t, target)
+		utest.EqualNow(t, code, string(codeOK))
+		client := "client=" + conn.LocalAddr().String() + " "
+		conn.Close()
+		var fields map[string]string
+		for i := 0; i < 100 && fields == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+			fields = accessLogFields(buf, client)
+		}
+		utest.NotNilNow(t, fields)
+		return fields
+	}
+
+	// hostname target logs the IP connected
+	fields := logged("localhost:" + port)
+	utest.EqualNow(t, fields["target"], "localhost:"+port)
+	utest.EqualNow(t, fields["remote"], listener.Addr().String())
+
+	// same as IP target
+	fields = logged(listener.Addr().String())
+	_, ok := fields["remote"]
+	utest.Assert(t, !ok, fields)
+}
+
+func Test_RefusedCode(t *testing.T) {
+	// host is up but nothing listens on the port
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	dead.Close()
+
+	oldRefused, oldRetry := cfgRefusedCode, cfgDialRetry
+	defer func() {
+		cfgRefusedCode, cfgDialRetry = oldRefused, oldRetry
+	}()
+	cfgDialRetry = 3
+
+	conn, code := dialTarget(t, dead.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialErr))
+
+	cfgRefusedCode = true
+	retries := dialRetries.Value()
+	conn, code = dialTarget(t, dead.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeRefused))
+	utest.EqualNow(t, dialRetries.Value(), retries)
+
+	// other errors are unchanged
+	utest.EqualNow(t, string(dialErrCode(errors.New("no route"))), string(codeDialErr))
+	utest.EqualNow(t, string(dialErrCode(&net.OpError{Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)})), string(codeDialErr))
+}
+
+func Test_LogFailures(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	dead.Close()
+
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	oldLogFailures := cfgLogFailures
+	defer func() {
+		cfgLogFailures = oldLogFailures
+	}()
+	cfgLogFailures = true
+
+	// the line is written after the reply
+	logged := func(conn net.Conn) map[string]string {
+		var fields map[string]string
+		for i := 0; i < 100 && fields == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+			fields = accessLogFields(buf, "client="+conn.LocalAddr().String()+" ")
+		}
+		return fields
+	}
+
+	// successful tunnel is not logged
+	conn, code := dialTarget(t, listener.Addr().String())
+	utest.EqualNow(t, code, string(codeOK))
+	ok := "client=" + conn.LocalAddr().String() + " "
+	conn.Close()
+
+	// dial error
+	conn, code = dialTarget(t, dead.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialErr))
+	fields := logged(conn)
+	utest.NotNilNow(t, fields)
+	utest.EqualNow(t, fields["reason"], "dial")
+	utest.EqualNow(t, fields["target"], dead.Addr().String())
+
+	// bad handshake
+	conn, err = net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte("garbage\n"))
+	utest.IsNilNow(t, err)
+	ioutil.ReadAll(conn)
+	conn.Close()
+	fields = logged(conn)
+	utest.NotNilNow(t, fields)
+	utest.EqualNow(t, fields["reason"], "handshake")
+
+	time.Sleep(100 * time.Millisecond)
+	utest.Assert(t, !strings.Contains(buf.String(), ok), buf.String())
+}
+
+func Test_IdleKeepAlive(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldIdleAlive, oldSetKeepAlive := cfgIdleAlive, setKeepAlive
+	defer func() {
+		cfgIdleAlive, setKeepAlive = oldIdleAlive, oldSetKeepAlive
+	}()
+	cfgIdleAlive = uint(300 * time.Millisecond)
+
+	// record the toggles of target connection
+	var mu sync.Mutex
+	var toggles []bool
+	setKeepAlive = func(conn net.Conn, on bool) error {
+		if conn.RemoteAddr().String() == listener.Addr().String() {
+			mu.Lock()
+			toggles = append(toggles, on)
+			mu.Unlock()
+		}
+		return oldSetKeepAlive(conn, on)
+	}
+	recorded := func() []bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]bool(nil), toggles...)
+	}
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// disabled while active
+	reply := make([]byte, 4)
+	for i := 0; i < 10; i++ {
+		_, err := conn.Write([]byte("ping"))
+		utest.IsNilNow(t, err)
+		_, err = io.ReadFull(conn, reply)
+		utest.IsNilNow(t, err)
+		time.Sleep(20 * time.Millisecond)
+	}
+	utest.EqualNow(t, fmt.Sprint(recorded()), "[false]")
+
+	// enabled after idle
+	time.Sleep(600 * time.Millisecond)
+	utest.EqualNow(t, fmt.Sprint(recorded()), "[false true]")
+
+	// disabled again once active
+	_, err := conn.Write([]byte("ping"))
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	for i := 0; i < 100 && len(recorded()) < 3; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	utest.Assert(t, len(recorded()) >= 3, recorded())
+	utest.EqualNow(t, fmt.Sprint(recorded()[:3]), "[false true false]")
+}
+
+func Test_AcctFlush(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	oldAcctFlush := cfgAcctFlush
+	defer func() {
+		cfgAcctFlush = oldAcctFlush
+	}()
+	cfgAcctFlush = uint(100 * time.Millisecond)
+	flushes := interimFlushes.Value()
+	sent := mapValue(transferBytes, "sent")
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	utest.EqualNow(t, code, string(codeOK))
+	client := "client=" + conn.LocalAddr().String()
+	_, err := conn.Write([]byte("ping"))
+	utest.IsNilNow(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	time.Sleep(250 * time.Millisecond)
+
+	// interim counts of the alive tunnel, the last one has all the bytes
+	var last string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, client+" ") {
+			last = line
+		}
+	}
+	utest.Assert(t, strings.Contains(last, " sent=4 received=4 reason=active"), last)
+	utest.Assert(t, interimFlushes.Value() >= flushes+2, interimFlushes.Value()-flushes)
+	utest.Assert(t, mapValue(transferBytes, "sent") >= sent+4, mapValue(transferBytes, "sent")-sent)
+
+	// final line once closed
+	conn.Close()
+	var closed bool
+	for i := 0; i < 100 && !closed; i++ {
+		time.Sleep(10 * time.Millisecond)
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(line, client+" ") && !strings.Contains(line, "reason=active") {
+				closed = true
+			}
+		}
+	}
+	utest.Assert(t, closed, buf.String())
+}
+
+func Test_RuntimeStats(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	_, err := conn.Write([]byte("ping"))
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	utest.IsNilNow(t, err)
+
+	sampleRuntime()
+	utest.Assert(t, mapValue(runtimeStats, "goroutines") > 2)
+	utest.Assert(t, mapValue(runtimeStats, "heapInuse") > 0)
+	// both directions of the tunnel hold a buffer
+	utest.Assert(t, mapValue(runtimeStats, "bufferBytes") >= 2*int64(cfgBufferSize))
+}
+
+func Test_BufferConfig(t *testing.T) {
+	oldSize, oldMax, oldSockBuf := cfgBufferSize, cfgMaxBuffer, cfgSockBuf
+	oldProfile, oldNoDelay := cfgProfile, cfgNoDelay
+	defer setGlobals(t, func() {
+		cfgBufferSize, cfgMaxBuffer, cfgSockBuf = oldSize, oldMax, oldSockBuf
+		cfgProfile, cfgNoDelay = oldProfile, oldNoDelay
+	})
+	setGlobals(t, func() {
+		cfgProfile = "throughput"
+		utest.IsNilNow(t, applyProfile(cfgProfile, nil))
+		cfgMaxBuffer = 256 * 1024
+		cfgSockBuf = "db:3306=262144"
+	})
+
+	var config map[string]interface{}
+	utest.IsNilNow(t, json.Unmarshal([]byte(expvar.Get("buffers").String()), &config))
+	utest.EqualNow(t, config["size"], float64(64*1024))
+	utest.EqualNow(t, config["max"], float64(256*1024))
+	utest.EqualNow(t, config["pool"], copyPool)
+	utest.EqualNow(t, config["profile"], "throughput")
+	utest.EqualNow(t, config["sockbuf"], "db:3306=262144")
+}
+
+func Test_HandshakeSizes(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(encryptedAddr), 44)
+
+	count, sum := mapValue(handshakeSizes, "count"), mapValue(handshakeSizes, "sum")
+	le48, inf := mapValue(handshakeSizes, "48"), mapValue(handshakeSizes, "+Inf")
+	longest := mapValue(handshakeSizes, strconv.Itoa(maxHandshakeLen))
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// too long without newline
+	conn, err = net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	_, err = conn.Write(bytes.Repeat([]byte("A"), 100))
+	utest.IsNilNow(t, err)
+	reply, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	utest.EqualNow(t, string(reply), string(codeBadReq))
+
+	utest.EqualNow(t, mapValue(handshakeSizes, "count"), count+2)
+	utest.EqualNow(t, mapValue(handshakeSizes, "sum"), sum+44+int64(maxHandshakeLen+1))
+	utest.EqualNow(t, mapValue(handshakeSizes, "48"), le48+1)
+	utest.EqualNow(t, mapValue(handshakeSizes, "+Inf"), inf+1)
+	utest.EqualNow(t, mapValue(handshakeSizes, strconv.Itoa(maxHandshakeLen)), longest)
+}
+
+func Test_DecryptTimes(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	count := mapValue(decryptTimes, "count")
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	utest.EqualNow(t, mapValue(decryptTimes, "count"), count+1)
+
+	// every observation falls in one bucket
+	count, sum, le10, inf := mapValue(decryptTimes, "count"), mapValue(decryptTimes, "sum"), mapValue(decryptTimes, "10"), mapValue(decryptTimes, "+Inf")
+	observeDecryptTime(5 * time.Microsecond)
+	observeDecryptTime(2 * time.Millisecond)
+	utest.EqualNow(t, mapValue(decryptTimes, "count"), count+2)
+	utest.EqualNow(t, mapValue(decryptTimes, "sum"), sum+2005)
+	utest.EqualNow(t, mapValue(decryptTimes, "10"), le10+1)
+	utest.EqualNow(t, mapValue(decryptTimes, "+Inf"), inf+1)
+}
+
+func Test_SpawnWait(t *testing.T) {
+	oldLimiter := spawnLimiter
+	defer setGlobals(t, func() {
+		spawnLimiter = oldLimiter
+	})
+	setGlobals(t, func() {
+		spawnLimiter = &rateLimiter{rate: 10}
+	})
+
+	waits, nanos := mapValue(spawnWait, "waits"), mapValue(spawnWait, "nanoseconds")
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+	}
+
+	// a connection is accepted every 100ms, the first one without waiting,
+	// the later ones wait less if they arrived late
+	for i := 0; i < 100 && mapValue(spawnWait, "waits") < waits+4; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	utest.EqualNow(t, mapValue(spawnWait, "waits"), waits+4)
+	wait := time.Duration(mapValue(spawnWait, "nanoseconds") - nanos)
+	utest.Assert(t, wait >= 200*time.Millisecond && wait < time.Second, wait)
+}
+
+func Test_DialScope(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	oldScope, oldTimeout, oldRetry := cfgDialScope, cfgDialTimeout, cfgDialRetry
+	oldLookup, oldDial := lookupHost, dialTimeout
+	defer func() {
+		cfgDialScope, cfgDialTimeout, cfgDialRetry = oldScope, oldTimeout, oldRetry
+		lookupHost, dialTimeout = oldLookup, oldDial
+	}()
+	cfgDialTimeout = uint(100 * time.Millisecond)
+	cfgDialRetry = 1
+
+	// two dead IPs before the live one
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"192.0.2.1", "192.0.2.2", "127.0.0.1"}, nil
+	}
+	var mu sync.Mutex
+	var dials []string
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		mu.Lock()
+		dials = append(dials, address+" "+timeout.String())
+		mu.Unlock()
+		if strings.HasPrefix(address, "127.0.0.1:") {
+			return net.DialTimeout(network, address, timeout)
+		}
+		return nil, TestError{true, false}
+	}
+
+	// every IP gets the full timeout
+	cfgDialScope = "ip"
+	conn, code := dialTarget(t, "multi.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	mu.Lock()
+	utest.EqualNow(t, strings.Join(dials, ","), "192.0.2.1:"+port+" 100ms,192.0.2.2:"+port+" 100ms,127.0.0.1:"+port+" 100ms")
+	dials = nil
+	mu.Unlock()
+
+	// the dialer shares the timeout between IPs
+	cfgDialScope = "total"
+	conn, code = dialTarget(t, "multi.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialTimeout))
+	mu.Lock()
+	utest.EqualNow(t, strings.Join(dials, ","), "multi.test:"+port+" 100ms")
+	mu.Unlock()
+}
+
+func Test_DialPath(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	buf, restore := captureLog()
+	defer restore()
+
+	oldScope, oldRetry := cfgDialScope, cfgDialRetry
+	oldLookup, oldDial := lookupHost, dialTimeout
+	defer func() {
+		cfgDialScope, cfgDialRetry = oldScope, oldRetry
+		lookupHost, dialTimeout = oldLookup, oldDial
+	}()
+	cfgDialScope = "ip"
+	cfgDialRetry = 2
+
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host == "dead.test" {
+			return []string{"192.0.2.1"}, nil
+		}
+		return []string{"192.0.2.1", "192.0.2.2", "127.0.0.1"}, nil
+	}
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if strings.HasPrefix(address, "127.0.0.1:") {
+			return net.DialTimeout(network, address, timeout)
+		}
+		return nil, TestError{true, false}
+	}
+
+	// the path is logged when handshake returns, after the code is replied
+	logged := func(line string) bool {
+		for i := 0; i < 100 && !strings.Contains(buf.String(), line); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return strings.Contains(buf.String(), line)
+	}
+
+	// failed over to the last IP
+	conn, code := dialTarget(t, "multi.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	utest.Assert(t, logged("Dial multi.test:"+port+" of "+conn.LocalAddr().String()+" tried "+
+		"192.0.2.1:"+port+" (This is test error), 192.0.2.2:"+port+" (This is test error), 127.0.0.1:"+port+" (ok)\n"), buf.String())
+
+	// the path of retries is logged on failure
+	conn, code = dialTarget(t, "dead.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialTimeout))
+	utest.Assert(t, logged("Dial dead.test:"+port+" of "+conn.LocalAddr().String()+" tried "+
+		"192.0.2.1:"+port+" (This is test error), 192.0.2.1:"+port+" (This is test error)\n"), buf.String())
+
+	// nothing to tell without failover
+	conn, code = dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	time.Sleep(100 * time.Millisecond)
+	utest.Assert(t, !strings.Contains(buf.String(), "Dial "+listener.Addr().String()), buf.String())
+}
+
+func Test_DialPrefer(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	oldScope, oldPrefer, oldRetry := cfgDialScope, cfgDialPrefer, cfgDialRetry
+	oldLookup, oldDial := lookupHost, dialTimeout
+	defer func() {
+		cfgDialScope, cfgDialPrefer, cfgDialRetry = oldScope, oldPrefer, oldRetry
+		lookupHost, dialTimeout = oldLookup, oldDial
+	}()
+	cfgDialRetry = 1
+
+	// dual-stack target, only IPv4 is reachable
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"2001:db8::1", "127.0.0.1"}, nil
+	}
+	var mu sync.Mutex
+	var dials []string
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		mu.Lock()
+		dials = append(dials, network+" "+address)
+		mu.Unlock()
+		if strings.HasPrefix(address, "127.0.0.1:") || (network == "tcp4" && strings.HasPrefix(address, "dual.test:")) {
+			return net.DialTimeout("tcp", "127.0.0.1:"+port, timeout)
+		}
+		// v6.test has no IPv4 address and its IPv6 address is dead
+		if strings.HasPrefix(address, "v6.test:") {
+			if network == "tcp4" {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "no suitable address found", Addr: "v6.test"}}
+			}
+			return nil, TestError{timeout: true}
+		}
+		return nil, errors.New("unreachable in test")
+	}
+	dialed := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		s := strings.Join(dials, ",")
+		dials = nil
+		return s
+	}
+
+	// resolved IPs are ordered by preference
+	cfgDialScope = "ip"
+	cfgDialPrefer = "ipv4"
+	conn, code := dialTarget(t, "dual.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	utest.EqualNow(t, dialed(), "tcp 127.0.0.1:"+port)
+
+	cfgDialPrefer = "ipv6"
+	conn, code = dialTarget(t, "dual.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	utest.EqualNow(t, dialed(), "tcp [2001:db8::1]:"+port+",tcp 127.0.0.1:"+port)
+
+	// the dialer is asked for one family at a time
+	cfgDialScope = "total"
+	cfgDialPrefer = "ipv4"
+	conn, code = dialTarget(t, "dual.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	utest.EqualNow(t, dialed(), "tcp4 dual.test:"+port)
+
+	cfgDialPrefer = "ipv6"
+	conn, code = dialTarget(t, "dual.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	utest.EqualNow(t, dialed(), "tcp6 dual.test:"+port+",tcp4 dual.test:"+port)
+
+	// the other family tells the outcome when preferred one has no address
+	buf, restore := captureLog()
+	defer restore()
+	cfgDialPrefer = "ipv4"
+	conn, code = dialTarget(t, "v6.test:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialTimeout))
+	utest.EqualNow(t, dialed(), "tcp4 v6.test:"+port+",tcp6 v6.test:"+port)
+	tried := "tried tcp4 v6.test:" + port + " (dial tcp4: address v6.test: no suitable address found), tcp6 v6.test:" + port + " (This is test error)"
+	for i := 0; i < 100 && !strings.Contains(buf.String(), tried); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.Assert(t, strings.Contains(buf.String(), tried), buf.String())
+
+	// a blackholed preferred family leaves time for the other one
+	var timeouts []time.Duration
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		timeouts = append(timeouts, timeout)
+		if network == "tcp6" {
+			time.Sleep(timeout)
+			return nil, TestError{timeout: true}
+		}
+		return net.DialTimeout("tcp", "127.0.0.1:"+port, timeout)
+	}
+	cfgDialPrefer = "ipv6"
+	var path dialPath
+	conn, err = dialPreferred("dual.test:"+port, 200*time.Millisecond, &path)
+	utest.IsNilNow(t, err)
+	conn.Close()
+	utest.EqualNow(t, len(timeouts), 2)
+	utest.EqualNow(t, timeouts[0], 100*time.Millisecond)
+	utest.Assert(t, timeouts[1] > 0 && timeouts[1] <= 100*time.Millisecond, timeouts[1])
+	utest.EqualNow(t, len(path), 2)
+}
+
+func Test_FallbackDelay(t *testing.T) {
+	oldFallback := cfgFallback
+	defer func() {
+		cfgFallback = oldFallback
+	}()
+
+	cfgFallback = uint(250 * time.Millisecond)
+	d := newDialer(time.Second)
+	utest.EqualNow(t, d.Timeout, time.Second)
+	utest.EqualNow(t, d.FallbackDelay, 250*time.Millisecond)
+
+	cfgFallback = uint(50 * time.Millisecond)
+	utest.EqualNow(t, newDialer(time.Second).FallbackDelay, 50*time.Millisecond)
+
+	// no racing
+	cfgFallback = 0
+	utest.Assert(t, newDialer(time.Second).FallbackDelay < 0)
+}
+
+func Test_IPLiteralTarget(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	oldScope, oldRetry := cfgDialScope, cfgDialRetry
+	oldLookup, oldDial := lookupHost, dialTimeout
+	defer func() {
+		cfgDialScope, cfgDialRetry = oldScope, oldRetry
+		lookupHost, dialTimeout = oldLookup, oldDial
+	}()
+	cfgDialScope = "ip"
+	cfgDialRetry = 1
+
+	var mu sync.Mutex
+	var lookups, dials []string
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		lookups = append(lookups, host)
+		mu.Unlock()
+		return nil, errors.New("no resolver in test")
+	}
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		mu.Lock()
+		dials = append(dials, address)
+		mu.Unlock()
+		if strings.HasPrefix(address, "127.0.0.1:") {
+			return net.DialTimeout(network, address, timeout)
+		}
+		return nil, errors.New("unreachable in test")
+	}
+
+	conn, code := dialTarget(t, "127.0.0.1:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	conn, code = dialTarget(t, "[::ffff:127.0.0.1]:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	conn, code = dialTarget(t, "[fe80::1%lo]:"+port)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialErr))
+
+	mu.Lock()
+	defer mu.Unlock()
+	utest.EqualNow(t, len(lookups), 0)
+	utest.EqualNow(t, strings.Join(dials, ","), "127.0.0.1:"+port+",127.0.0.1:"+port+",[fe80::1%lo]:"+port)
+}
+
+func Test_ErrorDelay(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldDelay := cfgErrorDelay
+	defer setGlobals(t, func() {
+		cfgErrorDelay = oldDelay
+	})
+	setGlobals(t, func() {
+		cfgErrorDelay = uint(200 * time.Millisecond)
+	})
+
+	// bad address is delayed
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	begin := time.Now()
+	_, err = conn.Write([]byte("bad address\n"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeBadAddr))
+	utest.Assert(t, time.Since(begin) >= 200*time.Millisecond, time.Since(begin))
+
+	// success is not
+	begin = time.Now()
+	conn2, code2 := dialTarget(t, listener.Addr().String())
+	conn2.Close()
+	utest.EqualNow(t, code2, string(codeOK))
+	utest.Assert(t, time.Since(begin) < 200*time.Millisecond, time.Since(begin))
+}
+
+// startConnectProxy starts an HTTP CONNECT proxy which requires the
+// Proxy-Authorization header to be auth.
+func startConnectProxy(t *testing.T, auth string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener
+}
+
+func Test_Upstream(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldURL, oldToken := cfgUpstreamURL, cfgBearerToken
+	defer func() {
+		cfgUpstreamURL, cfgBearerToken = oldURL, oldToken
+	}()
+
+	testTunnel := func(expected string) {
+		conn, code := dialTarget(t, listener.Addr().String())
+		defer conn.Close()
+		utest.EqualNow(t, code, expected)
+		if code != string(codeOK) {
+			return
+		}
+		_, err := conn.Write([]byte("ping"))
+		utest.IsNilNow(t, err)
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(reply), "ping")
+	}
+
+	// basic auth
+	proxy := startConnectProxy(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	defer proxy.Close()
+
+	_, err := parseUpstream("socks5://" + proxy.Addr().String())
+	utest.NotNilNow(t, err)
+
+	cfgUpstreamURL, err = parseUpstream("http://user:pass@" + proxy.Addr().String())
+	utest.IsNilNow(t, err)
+	testTunnel(string(codeOK))
+
+	cfgUpstreamURL, err = parseUpstream("http://user:wrong@" + proxy.Addr().String())
+	utest.IsNilNow(t, err)
+	testTunnel(string(codeDialErr))
+
+	// bearer token
+	proxy2 := startConnectProxy(t, "Bearer token")
+	defer proxy2.Close()
+
+	cfgUpstreamURL, err = parseUpstream("http://" + proxy2.Addr().String())
+	utest.IsNilNow(t, err)
+	testTunnel(string(codeDialErr))
+	cfgBearerToken = "token"
+	testTunnel(string(codeOK))
+}
+
+func Test_SetupBudget(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldBudget, oldTimeout, oldRetry, oldDial := cfgSetupBudget, cfgDialTimeout, cfgDialRetry, dialTimeout
+	defer setGlobals(t, func() {
+		cfgSetupBudget, cfgDialTimeout, cfgDialRetry, dialTimeout = oldBudget, oldTimeout, oldRetry, oldDial
+	})
+	setGlobals(t, func() {
+		cfgSetupBudget = uint(150 * time.Millisecond)
+		cfgDialTimeout = uint(3 * time.Second)
+		cfgDialRetry = 3
+	})
+
+	// in budget
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// slow handshake
+	budgetTimeouts := mapValue(timeoutStats, "setupbudget")
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr))
+	utest.IsNilNow(t, err)
+	time.Sleep(200 * time.Millisecond)
+	conn.Write([]byte("\n"))
+	reply, _ := ioutil.ReadAll(conn)
+	utest.EqualNow(t, string(reply), string(codeBadReq))
+	utest.EqualNow(t, mapValue(timeoutStats, "setupbudget"), budgetTimeouts+1)
+
+	// dial timeouts are capped by the remaining budget
+	var mu sync.Mutex
+	var timeouts []time.Duration
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		mu.Lock()
+		timeouts = append(timeouts, timeout)
+		mu.Unlock()
+		time.Sleep(timeout)
+		return nil, TestError{true, false}
+	}
+	begin := time.Now()
+	conn, code = dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialTimeout))
+	utest.Assert(t, time.Since(begin) < 500*time.Millisecond, time.Since(begin))
+	mu.Lock()
+	defer mu.Unlock()
+	utest.Assert(t, len(timeouts) > 0)
+	for _, timeout := range timeouts {
+		utest.Assert(t, timeout <= 150*time.Millisecond, timeout)
+	}
+}
+
+func Test_TargetDials(t *testing.T) {
+	listener := startEchoServer(t)
+	target := listener.Addr().String()
+
+	dials := func(result string) int64 {
+		if m, ok := targetDials.Get(target).(*expvar.Map); ok {
+			return mapValue(m, result)
+		}
+		return 0
+	}
+
+	conn, code := dialTarget(t, target)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	utest.EqualNow(t, dials("success"), int64(1))
+	utest.EqualNow(t, dials("failure"), int64(0))
+
+	// the port is refused after listener closed
+	listener.Close()
+	conn, code = dialTarget(t, target)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeDialErr))
+	utest.EqualNow(t, dials("success"), int64(1))
+	utest.EqualNow(t, dials("failure"), int64(1))
+
+	// labels beyond the limit
+	labels := newLabelSet(1)
+	utest.EqualNow(t, labels.label("a"), "a")
+	utest.EqualNow(t, labels.label("b"), "other")
+	utest.EqualNow(t, labels.label("a"), "a")
+}
+
+func Test_StatusPage(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	render := func() string {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+		utest.EqualNow(t, w.Code, http.StatusOK)
+		return w.Body.String()
+	}
+	row := func(name string, value interface{}) string {
+		return fmt.Sprintf("<tr><td>%s</td><td>%v</td></tr>", name, value)
+	}
+
+	failures := recentFailures.sum()
+	conn, code := dialTarget(t, listener.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	bad, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	bad.Write([]byte("garbage\n"))
+	ioutil.ReadAll(bad)
+	bad.Close()
+	for i := 0; i < 100 && recentFailures.sum() == failures; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	page := render()
+	utest.Assert(t, strings.Contains(page, "<h1>Gateway "+cfgGatewayAddr+"</h1>"), page)
+	utest.Assert(t, strings.Contains(page, "<tr><td>Uptime</td><td>"), page)
+	utest.Assert(t, activeTunnels.Value() >= 1, activeTunnels.Value())
+	utest.Assert(t, strings.Contains(page, row("Active tunnels", activeTunnels.Value())), page)
+	utest.Assert(t, strings.Contains(page, row("Total connections", acceptedConns.Value())), page)
+	utest.Assert(t, recentFailures.sum() > failures, recentFailures.sum())
+	utest.Assert(t, strings.Contains(page, fmt.Sprintf("<td>%d of %d (", recentFailures.sum(), recentConns.sum())), page)
+}
+
+func Test_RecentCounter(t *testing.T) {
+	c := newRecentCounter()
+	utest.EqualNow(t, c.sum(), int64(0))
+	c.add()
+	c.add()
+	utest.EqualNow(t, c.sum(), int64(2))
+
+	// counts older than the window are dropped
+	for i := range c.stamps {
+		c.stamps[i] -= int64(len(c.stamps))
+	}
+	utest.EqualNow(t, c.sum(), int64(0))
+}
+
+func Test_ShutdownServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	addr := listener.Addr().String()
+
+	// a slow request like profiling
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})}
+	go srv.Serve(listener)
+
+	result := make(chan string, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{}}
+		resp, err := client.Get("http://" + addr + "/debug/pprof/profile")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		result <- string(body)
+	}()
+	<-started
+
+	utest.IsNilNow(t, shutdownServer(srv, time.Second))
+	utest.EqualNow(t, <-result, "done")
+
+	// the port is released
+	listener, err = net.Listen("tcp", addr)
+	utest.IsNilNow(t, err)
+	listener.Close()
+}
+
+func Test_FirstByte(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldFirstByte := cfgFirstByte
+	defer setGlobals(t, func() {
+		cfgFirstByte = oldFirstByte
+	})
+	setGlobals(t, func() {
+		cfgFirstByte = uint(100 * time.Millisecond)
+	})
+	timeouts := mapValue(timeoutStats, "firstbyte")
+
+	// silent connection is closed quickly
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	begin := time.Now()
+	reply, _ := ioutil.ReadAll(conn)
+	utest.EqualNow(t, string(reply), string(codeBadReq))
+	utest.Assert(t, time.Since(begin) < 500*time.Millisecond, time.Since(begin))
+	utest.EqualNow(t, mapValue(timeoutStats, "firstbyte"), timeouts+1)
+
+	// slow handshake after the first byte is fine
+	conn2, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn2.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn2.Write([]byte(encryptedAddr[:1]))
+	utest.IsNilNow(t, err)
+	time.Sleep(200 * time.Millisecond)
+	_, err = conn2.Write([]byte(encryptedAddr[1:] + "\n"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn2, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+}
+
+// startNATS starts a stub NATS server which sends the payloads published to
+// subject into the returned channel.
+func startNATS(t *testing.T, subject string) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	msgs := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\nPING\r\n")
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					if len(fields) == 0 {
+						continue
+					}
+					switch fields[0] {
+					case "PONG":
+						msgs <- "PONG"
+					case "PUB":
+						n, _ := strconv.Atoi(fields[len(fields)-1])
+						payload := make([]byte, n+2)
+						if _, err := io.ReadFull(r, payload); err != nil {
+							return
+						}
+						if fields[1] == subject {
+							msgs <- string(payload[:n])
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return listener, msgs
+}
+
+func Test_Events(t *testing.T) {
+	_, _, err := parseEventBroker("kafka://127.0.0.1:9092/topic")
+	utest.NotNilNow(t, err)
+	_, subject, err := parseEventBroker("nats://127.0.0.1:4222")
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, subject, "gateway.tunnels")
+
+	broker, msgs := startNATS(t, "test.tunnels")
+	defer broker.Close()
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	addr, subject, err := parseEventBroker("nats://" + broker.Addr().String() + "/test.tunnels")
+	utest.IsNilNow(t, err)
+	oldEvents := events
+	setGlobals(t, func() {
+		events = newEventPublisher(addr, subject)
+	})
+	defer setGlobals(t, func() {
+		events.close()
+		events = oldEvents
+	})
+
+	next := func() string {
+		select {
+		case msg := <-msgs:
+			return msg
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+	// events of tunnels closed by other tests may come first
+	for msg := next(); msg != "PONG"; msg = next() {
+		utest.AssertNow(t, msg != "", "PONG timeout")
+	}
+
+	conn, code := dialTarget(t, listener.Addr().String())
+	utest.EqualNow(t, code, string(codeOK))
+	_, err = conn.Write([]byte("ping"))
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	utest.IsNilNow(t, err)
+	conn.Close()
+
+	// skip the events of tunnels left by other tests
+	nextEvent := func() (e tunnelEvent) {
+		for e.Client != conn.LocalAddr().String() {
+			msg := next()
+			if msg == "" {
+				t.Fatal("event timeout")
+			}
+			utest.IsNilNow(t, json.Unmarshal([]byte(msg), &e))
+		}
+		return
+	}
+	open := nextEvent()
+	utest.EqualNow(t, open.Event, "open")
+	utest.EqualNow(t, open.Target, listener.Addr().String())
+
+	closed := nextEvent()
+	utest.EqualNow(t, closed.Event, "close")
+	utest.EqualNow(t, closed.Sent, int64(4))
+	utest.EqualNow(t, closed.Received, int64(4))
+	utest.EqualNow(t, closed.Reason, "clean")
+
+	// the limit refused the connection is the reason
+	oldSecrets, oldAllow := cfgSecrets, cfgAllowList
+	defer func() {
+		cfgSecrets, cfgAllowList = oldSecrets, oldAllow
+	}()
+	cfgSecrets, err = parseSecrets("a=secret-a")
+	utest.IsNilNow(t, err)
+	cfgAllowList, err = parseAllowList("a=10.0.0.*:*")
+	utest.IsNilNow(t, err)
+	conn, err = net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString("secret-a", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte("a:" + encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	rejected := nextEvent()
+	utest.EqualNow(t, rejected.Event, "reject")
+	utest.EqualNow(t, rejected.Key, "a")
+	utest.EqualNow(t, rejected.Reason, "allow")
+}
+
+func Test_ShutdownGrace(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	go loop(gateway)
+
+	// only stop the gateway of this test
+	for i := 0; i < 100; i++ {
+		gatewayListenersMu.Lock()
+		ready := gatewayListeners[gateway]
+		gatewayListenersMu.Unlock()
+		if ready {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	gatewayListenersMu.Lock()
+	oldListeners := gatewayListeners
+	gatewayListeners = map[net.Listener]bool{gateway: true}
+	gatewayListenersMu.Unlock()
+	defer func() {
+		gatewayListenersMu.Lock()
+		gatewayListeners = oldListeners
+		gatewayListenersMu.Unlock()
+		atomic.StoreInt32(&stopping, 0)
+	}()
+
+	conn, err := net.Dial("tcp", gateway.Addr().String())
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr))
+	utest.IsNilNow(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	// shutdown starts in the middle of handshake
+	finished := make(chan bool)
+	go func() {
+		stopAccepting()
+		finished <- waitHandshakes(time.Second)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, err = net.Dial("tcp", gateway.Addr().String())
+	utest.NotNilNow(t, err)
+
+	_, err = conn.Write([]byte("\n"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+	utest.Assert(t, <-finished)
+}
+
+func Test_AddrFile(t *testing.T) {
+	oldAddr, oldFile := cfgGatewayAddr, cfgAddrFile
+	defer func() {
+		cfgGatewayAddr, cfgAddrFile = oldAddr, oldFile
+	}()
+
+	dir, err := ioutil.TempDir("", "gateway")
+	utest.IsNilNow(t, err)
+	defer os.RemoveAll(dir)
+
+	cfgGatewayAddr = "127.0.0.1:0"
+	cfgAddrFile = filepath.Join(dir, "gateway.addr")
+	start()
+
+	_, port, err := net.SplitHostPort(cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	utest.Assert(t, port != "0")
+
+	data, err := ioutil.ReadFile(cfgAddrFile)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(data), cfgGatewayAddr)
+
+	// the bound address is usable
+	listener := startEchoServer(t)
+	defer listener.Close()
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// bad path
+	cfgGatewayAddr = "127.0.0.1:0"
+	cfgAddrFile = filepath.Join(dir, "missing", "gateway.addr")
+	func() {
+		defer func() {
+			err := recover()
+			utest.NotNilNow(t, err)
+			utest.Assert(t, strings.Contains(err.(string), "Can't write address file"))
+		}()
+		start()
+	}()
+}
+
+// waitClosed waits for the tunnels of previous tests to be released.
+func waitClosed(t *testing.T, limit *connLimit) {
+	for i := 0; limit.count() != 0; i++ {
+		utest.AssertNow(t, i < 100, "tunnels not closed")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_MaxConns(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldMax, oldScope := cfgMaxConns, cfgConnsScope
+	defer func() {
+		cfgMaxConns, cfgConnsScope = oldMax, oldScope
+	}()
+	cfgMaxConns = 2
+	waitClosed(t, &globalConns)
+
+	startGateway := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		utest.IsNilNow(t, err)
+		go loop(l)
+		return l.Addr().String()
+	}
+	tunnel := func(gateway string) (net.Conn, string) {
+		oldAddr := cfgGatewayAddr
+		defer func() {
+			cfgGatewayAddr = oldAddr
+		}()
+		cfgGatewayAddr = gateway
+		return dialTarget(t, listener.Addr().String())
+	}
+
+	// global scope is shared by listeners
+	rejected := mapValue(rejections, "global")
+	gateway2 := startGateway()
+	conn1, code := tunnel(cfgGatewayAddr)
+	defer conn1.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	conn2, code := tunnel(gateway2)
+	defer conn2.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	conn, code := tunnel(cfgGatewayAddr)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeTooBusy))
+	conn, code = tunnel(gateway2)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeTooBusy))
+	utest.EqualNow(t, mapValue(rejections, "global"), rejected+2)
+
+	// listener scope
+	rejected = mapValue(rejections, "listener")
+	cfgConnsScope = "listener"
+	gateway3 := startGateway()
+	for i := 0; i < 2; i++ {
+		conn, code := tunnel(gateway3)
+		defer conn.Close()
+		utest.EqualNow(t, code, string(codeOK))
+	}
+	conn, code = tunnel(gateway3)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeTooBusy))
+	utest.EqualNow(t, mapValue(rejections, "listener"), rejected+1)
+
+	// slot is released after tunnel closed
+	conn1.Close()
+	for i := 0; globalConns.count() != 1; i++ {
+		utest.AssertNow(t, i < 100, "tunnel not closed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, code = tunnel(cfgGatewayAddr)
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+}
+
+func Test_BufferAllocs(t *testing.T) {
+	var bufs []interface{}
+	defer func() {
+		for _, b := range bufs {
+			copyBufPool.Put(b)
+		}
+	}()
+
+	// empty the pool and hold buffers so the pool has to allocate
+	runtime.GC()
+	runtime.GC()
+	// tunnels left by other tests may still put buffers back
+	n := bufferAllocs.Value()
+	for i := 0; i < 100 && bufferAllocs.Value() < n+10; i++ {
+		bufs = append(bufs, copyBufPool.Get())
+	}
+	utest.Assert(t, bufferAllocs.Value() >= n+10, bufferAllocs.Value()-n)
+}
+
+func Test_PutCopyBuf(t *testing.T) {
+	n := badBufferPuts.Value()
+
+	buf := make([]byte, cfgBufferSize-1)
+	utest.Assert(t, !putCopyBuf(&buf))
+	utest.EqualNow(t, badBufferPuts.Value(), n+1)
+
+	buf = make([]byte, cfgBufferSize)
+	utest.Assert(t, putCopyBuf(&buf))
+	utest.EqualNow(t, badBufferPuts.Value(), n+1)
+}
+
+// Test_CopyIntegrity pushes random data through concurrent tunnels, run it
+// with -race and again with -tags nopool to compare pooled and fresh copy
+// buffers.
+func Test_CopyIntegrity(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, code := dialTarget(t, listener.Addr().String())
+			defer conn.Close()
+			utest.EqualNow(t, code, string(codeOK))
+
+			data := make([]byte, 256*1024)
+			rand.Read(data)
+			go func() {
+				for b := data; len(b) > 0; {
+					n := rand.Intn(8192) + 1
+					if n > len(b) {
+						n = len(b)
+					}
+					if _, err := conn.Write(b[:n]); err != nil {
+						return
+					}
+					b = b[n:]
+				}
+			}()
+			reply := make([]byte, len(data))
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			_, err := io.ReadFull(conn, reply)
+			utest.IsNilNow(t, err)
+			utest.Assert(t, bytes.Equal(reply, data))
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_SelfDial(t *testing.T) {
+	_, port, err := net.SplitHostPort(cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+
+	for _, target := range []string{cfgGatewayAddr, "127.0.0.1:" + port, "localhost:" + port, "0.0.0.0:" + port} {
+		conn, code := dialTarget(t, target)
+		conn.Close()
+		utest.EqualNow(t, code, string(codeLoop))
+	}
+
+	// other ports are fine
+	listener := startEchoServer(t)
+	defer listener.Close()
+	conn, code := dialTarget(t, listener.Addr().String())
+	conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+
+	// listener bound to a specific address
+	addr := addListenAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1})
+	utest.Assert(t, isSelf("127.0.0.2:1", time.Second))
+	utest.Assert(t, !isSelf("127.0.0.3:1", time.Second))
+	utest.Assert(t, selfConn(&remoteConn{remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1}}))
+	utest.Assert(t, !selfConn(&remoteConn{remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.3"), Port: 1}}))
+
+	// names are checked after dialing, not resolved before
+	oldLookup := lookupHost
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		t.Errorf("%s resolved before dialing", host)
+		return nil, errors.New("unreachable in test")
+	}
+	utest.Assert(t, !isSelf("self.test:1", time.Second))
+
+	// the address dialed by upstream proxy is unknown, names are resolved
+	oldUpstream := cfgUpstreamURL
+	cfgUpstreamURL = &url.URL{Scheme: "http", Host: "127.0.0.1:1"}
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		_, ok := ctx.Deadline()
+		utest.Assert(t, ok, "resolved without deadline")
+		return []string{"127.0.0.2"}, nil
+	}
+	utest.Assert(t, isSelf("self.test:1", time.Second))
+	cfgUpstreamURL, lookupHost = oldUpstream, oldLookup
+	removeListenAddr(addr)
+	utest.Assert(t, !isSelf("127.0.0.2:1", time.Second))
+
+	// allowed by config
+	cfgAllowSelf = true
+	defer func() {
+		cfgAllowSelf = false
+	}()
+	conn, code = dialTarget(t, "127.0.0.1:"+port)
+	conn.Close()
+	utest.Assert(t, code != string(codeLoop))
+}
+
+func Test_GatewayChain(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldSecrets, oldAllowSelf := cfgSecrets, cfgAllowSelf
+	defer func() {
+		cfgSecrets, cfgAllowSelf = oldSecrets, oldAllowSelf
+	}()
+	var err error
+	cfgSecrets, err = parseSecrets("hop1=secret-1,hop2=secret-2,hop3=secret-3")
+	utest.IsNilNow(t, err)
+	cfgAllowSelf = true
+
+	startGateway := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		utest.IsNilNow(t, err)
+		go loop(l)
+		return l.Addr().String()
+	}
+	hops := []string{cfgGatewayAddr, startGateway(), startGateway(), listener.Addr().String()}
+
+	// every hop peels one layer encrypted for it
+	conn, err := net.Dial("tcp", hops[0])
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	for i := 1; i < len(hops); i++ {
+		id := "hop" + strconv.Itoa(i)
+		encryptedAddr, err := aes256cbc.EncryptString("secret-"+strconv.Itoa(i), hops[i])
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(id + ":" + encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(code), string(codeOK))
+	}
+
+	_, err = conn.Write([]byte("ping"))
+	utest.IsNilNow(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), "ping")
+}
+
+// captureLog redirects log output to a buffer until the returned function
+// is called.
+func captureLog() (*syncBuffer, func()) {
+	buf := new(syncBuffer)
+	log.SetOutput(buf)
+	return buf, func() {
+		log.SetOutput(ioutil.Discard)
+	}
+}
+
+func Test_Ready(t *testing.T) {
+	oldAddr := cfgGatewayAddr
+	defer func() {
+		cfgGatewayAddr = oldAddr
+	}()
+
+	buf, restore := captureLog()
+	defer restore()
+
+	cfgGatewayAddr = "127.0.0.1:0"
+	start()
+
+	// the line is written once accepting
+	ready := "Gateway ready: " + cfgGatewayAddr + "\n"
+	for i := 0; i < 100 && !strings.Contains(buf.String(), ready); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.Assert(t, strings.Contains(buf.String(), ready), buf.String())
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	conn.Close()
+}
+
+func Test_ReadyAddr(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	// reserve a port for the dependency which isn't up yet
+	dep, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	depAddr := dep.Addr().String()
+	dep.Close()
+
+	oldAddr, oldReady, oldRetry := cfgGatewayAddr, cfgReadyAddr, cfgReadyRetry
+	defer func() {
+		cfgGatewayAddr, cfgReadyAddr, cfgReadyRetry = oldAddr, oldReady, oldRetry
+	}()
+	cfgGatewayAddr = "127.0.0.1:0"
+	cfgReadyAddr = depAddr
+	cfgReadyRetry = uint(50 * time.Millisecond)
+	logs, restore := captureLog()
+	defer restore()
+	start()
+	ready := "Gateway ready: " + cfgGatewayAddr + "\n"
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+
+	// the connection waits in backlog
+	code := make([]byte, 3)
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err = conn.Read(code)
+	ne, ok := err.(net.Error)
+	utest.Assert(t, ok && ne.Timeout(), err)
+	utest.Assert(t, !strings.Contains(logs.String(), ready), logs.String())
+
+	// accepted once the dependency is up
+	dep, err = net.Listen("tcp", depAddr)
+	utest.IsNilNow(t, err)
+	defer dep.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+	utest.Assert(t, strings.Contains(logs.String(), ready), logs.String())
+}
+
+var testBufPool1 = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 64)
+	},
+}
+
+var testBufPool2 = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 64)
+		return &buf
+	},
+}
+
+func benchmarkStorm(b *testing.B, limiter *rateLimiter) {
+	var wg sync.WaitGroup
+	peak := 0
+	for i := 0; i < b.N; i++ {
+		if limiter != nil {
+			limiter.wait(1)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(10 * time.Millisecond)
+		}()
+		if n := runtime.NumGoroutine(); n > peak {
+			peak = n
+		}
+	}
+	wg.Wait()
+	b.ReportMetric(float64(peak), "peak-goroutines")
+}
+
+func Benchmark_Storm(b *testing.B) {
+	benchmarkStorm(b, nil)
+}
+
+func Benchmark_StormPaced(b *testing.B) {
+	benchmarkStorm(b, &rateLimiter{rate: 10000, burst: spawnBurst})
 }
 
 func Benchmark_BufPool1(b *testing.B) {
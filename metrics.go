@@ -0,0 +1,205 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Targets beyond the limit are counted as "other".
+	maxTargetLabels = 256
+
+	// How often the runtime metrics are sampled, reading memory stats stops
+	// the world so it's not done on every fetch.
+	runtimeSampleInterval = 5 * time.Second
+)
+
+var (
+	// closeStats counts the tunnels by close reason.
+	closeStats = expvar.NewMap("closes")
+
+	// timeoutStats counts the connections closed by every timeout policy:
+	// "firstbyte" and "setupbudget" during handshake, "ttl", "nodata" and
+	// "stuck" of established tunnels.
+	timeoutStats = expvar.NewMap("timeouts")
+
+	// bufferAllocs counts the copy buffers allocated by pool, keeps growing
+	// under steady load means buffers are held too long.
+	bufferAllocs = expvar.NewInt("bufferAllocs")
+
+	// badBufferPuts counts the copy buffers of wrong size returned to pool.
+	badBufferPuts = expvar.NewInt("badBufferPuts")
+
+	// dialRetries counts the retries used by successful dials, it grows when
+	// targets are flaky.
+	dialRetries = expvar.NewInt("dialRetries")
+
+	// spawnWait counts the connections delayed by spawnrate and their total
+	// waiting time, the average wait tells how saturated the gateway is.
+	spawnWait = expvar.NewMap("spawnWait")
+
+	// targetDials counts the dial successes and failures of every target.
+	targetDials  = expvar.NewMap("targetDials")
+	targetLabels = newLabelSet(maxTargetLabels)
+
+	// droppedEvents counts the tunnel events dropped because the broker is
+	// unreachable or slow.
+	droppedEvents = expvar.NewInt("droppedEvents")
+
+	// recoveredPanics counts the panics recovered from connections.
+	recoveredPanics = expvar.NewInt("panics")
+
+	// acceptedConns counts the connections accepted, activeTunnels is the
+	// tunnels established and not closed yet.
+	acceptedConns = expvar.NewInt("accepted")
+	activeTunnels = expvar.NewInt("activeTunnels")
+
+	// breakGlassUses counts the handshakes of the break-glass passphrase.
+	breakGlassUses = expvar.NewInt("breakGlass")
+
+	// bannedConns counts the connections refused because of client IP bans.
+	bannedConns = expvar.NewInt("bannedConns")
+
+	// transferBytes counts the bytes forwarded by tunnels, "sent" is client
+	// to target and "received" is target to client. Long tunnels add interim
+	// counts every acctflush.
+	transferBytes = expvar.NewMap("transferBytes")
+
+	// interimFlushes counts the interim byte counts flushed by long tunnels.
+	interimFlushes = expvar.NewInt("interimFlushes")
+
+	// rejections counts the connections refused by every kind of limit.
+	rejections = expvar.NewMap("rejections")
+
+	// runtimeStats samples the goroutines, the bytes of copy buffers held by
+	// tunnels and the heap in use, to correlate load with resource usage.
+	runtimeStats = expvar.NewMap("runtime")
+
+	// handshakeSizes is a histogram of handshake line sizes in bytes, it has
+	// the count of every bucket by upper bound, "count" and "sum". The last
+	// bucket is the longest valid line, so "+Inf" only counts clients filling
+	// the handshake buffer without a newline, which may be attacks.
+	handshakeSizes       = expvar.NewMap("handshakeSizes")
+	handshakeSizeBuckets = []int{16, 32, 48, 64, 80, maxHandshakeLen}
+
+	// decryptTimes is a histogram of the time decrypting handshake addresses
+	// in microseconds, in the same layout as handshakeSizes, to compare the
+	// cost of ciphers.
+	decryptTimes       = expvar.NewMap("decryptMicros")
+	decryptTimeBuckets = []int{10, 50, 100, 500, 1000}
+)
+
+// Metrics are published by expvar, they can be fetched from /debug/vars of
+// the pprof address.
+func init() {
+	expvar.Publish("tenants", expvar.Func(tenantStats))
+	expvar.Publish("buffers", expvar.Func(bufferConfig))
+}
+
+// labelSet limits the distinct labels of a metric, labels beyond max are
+// reported as "other" so a scan of many values can't blow up the metrics.
+type labelSet struct {
+	mu     sync.Mutex
+	max    int
+	labels map[string]bool
+}
+
+func newLabelSet(max int) *labelSet {
+	return &labelSet{max: max, labels: make(map[string]bool)}
+}
+
+func (s *labelSet) label(l string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.labels[l] {
+		if len(s.labels) >= s.max {
+			return "other"
+		}
+		s.labels[l] = true
+	}
+	return l
+}
+
+var targetDialsMu sync.Mutex
+
+// countDial records the outcome of dialing target, including retries.
+func countDial(target string, ok bool) {
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+	label := targetLabels.label(target)
+	targetDialsMu.Lock()
+	m, _ := targetDials.Get(label).(*expvar.Map)
+	if m == nil {
+		m = new(expvar.Map).Init()
+		targetDials.Set(label, m)
+	}
+	targetDialsMu.Unlock()
+	m.Add(result, 1)
+}
+
+// bufferConfig reports the buffer settings in effect, after profile and
+// command line are applied.
+func bufferConfig() interface{} {
+	return map[string]interface{}{
+		"size":    cfgBufferSize,
+		"max":     cfgMaxBuffer,
+		"pool":    copyPool,
+		"profile": cfgProfile,
+		"sockbuf": cfgSockBuf,
+	}
+}
+
+func observeHandshakeSize(n int) {
+	bucket := "+Inf"
+	for _, le := range handshakeSizeBuckets {
+		if n <= le {
+			bucket = strconv.Itoa(le)
+			break
+		}
+	}
+	handshakeSizes.Add(bucket, 1)
+	handshakeSizes.Add("count", 1)
+	handshakeSizes.Add("sum", int64(n))
+}
+
+func observeDecryptTime(d time.Duration) {
+	us := int(d / time.Microsecond)
+	bucket := "+Inf"
+	for _, le := range decryptTimeBuckets {
+		if us <= le {
+			bucket = strconv.Itoa(le)
+			break
+		}
+	}
+	decryptTimes.Add(bucket, 1)
+	decryptTimes.Add("count", 1)
+	decryptTimes.Add("sum", int64(us))
+}
+
+func sampleRuntime() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := map[string]int64{
+		"goroutines":  int64(runtime.NumGoroutine()),
+		"bufferBytes": atomic.LoadInt64(&copyBufBytes),
+		"heapInuse":   int64(m.HeapInuse),
+	}
+	for k, v := range stats {
+		i := new(expvar.Int)
+		i.Set(v)
+		runtimeStats.Set(k, i)
+	}
+}
+
+func watchRuntime() {
+	sampleRuntime()
+	for range time.Tick(runtimeSampleInterval) {
+		sampleRuntime()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorQueueSize    = 64
+	mirrorWriteTimeout = time.Second
+)
+
+// mirror sends a copy of the client data to the tap target in background.
+// Data is dropped when the tap is unreachable or can't keep up, so the
+// tunnel is never slowed down by it.
+type mirror struct {
+	mu     sync.Mutex
+	ch     chan []byte
+	closed bool
+}
+
+func newMirror(addr string) *mirror {
+	m := &mirror{ch: make(chan []byte, mirrorQueueSize)}
+	go m.loop(addr)
+	return m
+}
+
+func (m *mirror) loop(addr string) {
+	defer func() {
+		for range m.ch {
+		}
+	}()
+
+	tap, err := net.DialTimeout("tcp", addr, time.Duration(cfgDialTimeout))
+	if err != nil {
+		printf("Mirror dial failed: %s", err)
+		return
+	}
+	defer tap.Close()
+	go io.Copy(ioutil.Discard, tap)
+
+	for b := range m.ch {
+		tap.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+		if _, err := tap.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+// send is called by the client to target direction while close may be
+// called by the other direction of tunnel.
+func (m *mirror) send(b []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.ch <- append([]byte(nil), b...):
+	default:
+	}
+}
+
+func (m *mirror) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	close(m.ch)
+}
+
+// mirrorConn mirrors everything written to the agent, which is the data
+// sent by client.
+type mirrorConn struct {
+	net.Conn
+	mirror *mirror
+	once   sync.Once
+}
+
+func (c *mirrorConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.mirror.send(p[:n])
+	}
+	return n, err
+}
+
+func (c *mirrorConn) Close() error {
+	c.once.Do(c.mirror.close)
+	return c.Conn.Close()
+}
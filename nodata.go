@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// dataWatch reaps the tunnels stuck after established. A tunnel is closed
+// with reason "nodata" when neither side sent anything in the timeout, or
+// with reason "stuck" when the client sent nothing and didn't read what
+// target sent for the timeout. It stops watching once the client sends.
+type dataWatch struct {
+	tun         *tunnel
+	conn, agent net.Conn
+	timeout     time.Duration
+	sent        int32 // client sent anything
+	received    int32 // target sent anything
+	blocked     int64 // unix nanoseconds when the write to client began, 0 when not writing
+	stopped     int32
+	timer       *time.Timer
+}
+
+// watchData wraps the connections of tun and starts watching them.
+func watchData(tun *tunnel, conn, agent net.Conn, timeout time.Duration) (*dataWatch, net.Conn, net.Conn) {
+	w := &dataWatch{tun: tun, conn: conn, agent: agent, timeout: timeout}
+	w.timer = time.AfterFunc(timeout, w.check)
+	return w, &watchClient{Conn: conn, w: w}, &watchAgent{Conn: agent, w: w}
+}
+
+func (w *dataWatch) check() {
+	if atomic.LoadInt32(&w.stopped) == 1 || atomic.LoadInt32(&w.sent) == 1 {
+		return
+	}
+	var reason string
+	if atomic.LoadInt32(&w.received) == 0 {
+		reason = "nodata"
+	} else if since := atomic.LoadInt64(&w.blocked); since != 0 && time.Since(time.Unix(0, since)) >= w.timeout {
+		reason = "stuck"
+	} else {
+		// the client may stop reading later
+		w.timer.Reset(w.timeout)
+		return
+	}
+	w.tun.kill(reason)
+	w.conn.Close()
+	w.agent.Close()
+}
+
+func (w *dataWatch) stop() {
+	atomic.StoreInt32(&w.stopped, 1)
+	w.timer.Stop()
+}
+
+type watchClient struct {
+	net.Conn
+	w *dataWatch
+}
+
+func (c *watchClient) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt32(&c.w.sent, 1)
+	}
+	return n, err
+}
+
+// Write is only called by the copy from target, so there is one write at a
+// time.
+func (c *watchClient) Write(p []byte) (int, error) {
+	atomic.StoreInt64(&c.w.blocked, time.Now().UnixNano())
+	n, err := c.Conn.Write(p)
+	atomic.StoreInt64(&c.w.blocked, 0)
+	return n, err
+}
+
+type watchAgent struct {
+	net.Conn
+	w *dataWatch
+}
+
+func (c *watchAgent) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt32(&c.w.received, 1)
+	}
+	return n, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// panicking is set when maxpanics is reached in "maintenance" mode, new
+	// connections are refused like maintenance mode.
+	panicking int32
+
+	// crash is replaced by tests.
+	crash = fatalf
+
+	panicBreaker struct {
+		sync.Mutex
+		since time.Time
+		n     int
+	}
+)
+
+// recovered logs a panic recovered from a connection. A bug triggered by
+// certain input may panic again and again, so after maxpanics in a window it
+// crashes the gateway for restart, or refuses new connections to keep the
+// established ones.
+func recovered(err interface{}) {
+	printf("panic: %v\n\n%s", err, debug.Stack())
+	recoveredPanics.Add(1)
+	if cfgMaxPanics == 0 {
+		return
+	}
+	panicBreaker.Lock()
+	now := time.Now()
+	if now.Sub(panicBreaker.since) > time.Duration(cfgPanicWindow) {
+		panicBreaker.since, panicBreaker.n = now, 0
+	}
+	panicBreaker.n++
+	n := panicBreaker.n
+	panicBreaker.Unlock()
+	if n < int(cfgMaxPanics) {
+		return
+	}
+	if cfgPanicMode == "crash" {
+		crash("Crash for %d panics in %s", n, time.Duration(cfgPanicWindow))
+		return
+	}
+	if atomic.CompareAndSwapInt32(&panicking, 0, 1) {
+		printf("Refuse new connections for %d panics in %s", n, time.Duration(cfgPanicWindow))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+type tuningProfile struct {
+	noDelay    bool
+	bufferSize uint
+}
+
+// profiles bundle the tuning options for a kind of traffic, "latency" sends
+// small writes immediately with small copy buffers, "throughput" lets TCP
+// coalesce small writes and copies with large buffers.
+var profiles = map[string]tuningProfile{
+	"latency":    {noDelay: true, bufferSize: 4 * 1024},
+	"throughput": {noDelay: false, bufferSize: 64 * 1024},
+}
+
+// applyProfile sets the options of the named profile, except the ones in set
+// which were given explicitly by command line.
+func applyProfile(name string, set map[string]bool) error {
+	if name == "" {
+		return nil
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return errors.New("unknown profile: " + name)
+	}
+	cfgNoDelay = p.noDelay
+	if !set["buffer"] {
+		cfgBufferSize = p.bufferSize
+	}
+	return nil
+}
+
+// setNoDelay applies the TCP_NODELAY of profile to a client or agent
+// connection, Go enables it by default.
+func setNoDelay(conn net.Conn) error {
+	if cfgProfile == "" {
+		return nil
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		return tc.SetNoDelay(cfgNoDelay)
+	}
+	return nil
+}
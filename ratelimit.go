@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type targetLimit struct {
+	pattern string
+	limiter *rateLimiter
+}
+
+// parseRateLimits parses a comma separated list of "pattern=bytes" pairs,
+// pattern is matched against the target address by path.Match.
+func parseRateLimits(s string) ([]targetLimit, error) {
+	var limits []targetLimit
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i <= 0 {
+			return nil, errors.New("bad rate limit: " + item)
+		}
+		pattern := item[:i]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("bad rate limit pattern: " + pattern)
+		}
+		rate, err := strconv.ParseInt(item[i+1:], 10, 64)
+		if err != nil || rate <= 0 {
+			return nil, errors.New("bad rate limit value: " + item)
+		}
+		limits = append(limits, targetLimit{pattern, &rateLimiter{rate: rate}})
+	}
+	return limits, nil
+}
+
+// matchRateLimit returns the limiter of the first pattern matching target.
+func matchRateLimit(target string) *rateLimiter {
+	for _, l := range cfgRateLimits {
+		if ok, _ := path.Match(l.pattern, target); ok {
+			return l.limiter
+		}
+	}
+	return nil
+}
+
+// rateLimiter spaces out events so they don't exceed rate units per second
+// in total, such as the bytes of all connections to a target pattern. Up to
+// burst of unused time can be caught up without waiting.
+type rateLimiter struct {
+	mu    sync.Mutex
+	rate  int64
+	burst time.Duration
+	next  time.Time
+}
+
+// wait blocks until n units are allowed and returns how long it waited.
+func (l *rateLimiter) wait(n int) time.Duration {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now.Add(-l.burst)) {
+		l.next = now.Add(-l.burst)
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return 0
+	}
+	time.Sleep(delay)
+	return delay
+}
+
+type limitConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (c *limitConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.limiter.wait(n)
+	return n, err
+}
+
+func (c *limitConn) Write(p []byte) (int, error) {
+	c.limiter.wait(len(p))
+	return c.Conn.Write(p)
+}
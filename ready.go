@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// waitReady withholds accepting until the dependency at cfgReadyAddr
+// accepts a TCP connection, it's checked again every cfgReadyRetry. The
+// clients connect meanwhile wait in the listen backlog. It returns false
+// when the gateway stops before that.
+func waitReady() bool {
+	for logged := false; ; {
+		conn, err := net.DialTimeout("tcp", cfgReadyAddr, time.Duration(cfgDialTimeout))
+		if err == nil {
+			conn.Close()
+			if logged {
+				printf("Dependency %s is ready", cfgReadyAddr)
+			}
+			return true
+		}
+		if !logged {
+			printf("Waiting for dependency %s: %s", cfgReadyAddr, err)
+			logged = true
+		}
+		time.Sleep(time.Duration(cfgReadyRetry))
+		if atomic.LoadInt32(&stopping) == 1 {
+			return false
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// scans is nil when the distinct targets of client IPs are not limited.
+var scans *scanLimiter
+
+// scanLimiter limits how many distinct targets a client IP may reach in a
+// sliding window, so the gateway can't be used to scan hosts and ports.
+// Reaching a target already seen in the window is always allowed.
+type scanLimiter struct {
+	mu      sync.Mutex
+	max     int
+	window  time.Duration
+	clients map[string]map[string]time.Time // last time of every target
+	sweepAt int
+}
+
+func newScanLimiter(max int, window time.Duration) *scanLimiter {
+	return &scanLimiter{
+		max:     max,
+		window:  window,
+		clients: make(map[string]map[string]time.Time),
+		sweepAt: 1024,
+	}
+}
+
+// allow records that ip reaches target, it reports false when target is a
+// new one beyond the limit.
+func (l *scanLimiter) allow(ip, target string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.clients) >= l.sweepAt {
+		l.sweep(now)
+	}
+	targets := l.clients[ip]
+	if targets == nil {
+		targets = make(map[string]time.Time)
+		l.clients[ip] = targets
+	}
+	l.expire(targets, now)
+	if _, ok := targets[target]; !ok && len(targets) >= l.max {
+		return false
+	}
+	targets[target] = now
+	return true
+}
+
+func (l *scanLimiter) expire(targets map[string]time.Time, now time.Time) {
+	for target, last := range targets {
+		if now.Sub(last) > l.window {
+			delete(targets, target)
+		}
+	}
+}
+
+// sweep forgets the clients without targets in the window, so scanners from
+// many addresses can't grow the map forever.
+func (l *scanLimiter) sweep(now time.Time) {
+	for ip, targets := range l.clients {
+		l.expire(targets, now)
+		if len(targets) == 0 {
+			delete(l.clients, ip)
+		}
+	}
+	l.sweepAt = 2 * len(l.clients)
+	if l.sweepAt < 1024 {
+		l.sweepAt = 1024
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// listenAddrs are the addresses of running accept loops, targets resolve
+// to one of them are rejected to avoid dialing gateway itself in a loop.
+var (
+	listenAddrsMu sync.Mutex
+	listenAddrs   = make(map[*net.TCPAddr]bool)
+)
+
+func addListenAddr(addr net.Addr) *net.TCPAddr {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	listenAddrsMu.Lock()
+	listenAddrs[tcpAddr] = true
+	listenAddrsMu.Unlock()
+	return tcpAddr
+}
+
+func removeListenAddr(addr *net.TCPAddr) {
+	listenAddrsMu.Lock()
+	delete(listenAddrs, addr)
+	listenAddrsMu.Unlock()
+}
+
+// isSelf reports whether target is one of the listen addresses. The host is
+// only resolved when the port is a listen port and the target is dialed
+// through upstream proxy, within timeout. Otherwise a name is checked by
+// selfConn after dialing, so a slow resolver can't stall the handshake.
+func isSelf(target string, timeout time.Duration) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	p, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return false
+	}
+	addrs := listenAddrsOn(p)
+	if len(addrs) == 0 {
+		return false
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if cfgUpstreamURL == nil {
+			return false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		names, err := lookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			return false
+		}
+		ips = ips[:0]
+		for _, name := range names {
+			ips = append(ips, net.ParseIP(name))
+		}
+	}
+	return selfIP(addrs, ips)
+}
+
+// selfConn reports whether a connection dialed without upstream proxy
+// reached one of the listen addresses.
+func selfConn(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && selfIP(listenAddrsOn(addr.Port), []net.IP{addr.IP})
+}
+
+func listenAddrsOn(port int) []*net.TCPAddr {
+	var addrs []*net.TCPAddr
+	listenAddrsMu.Lock()
+	for addr := range listenAddrs {
+		if addr.Port == port {
+			addrs = append(addrs, addr)
+		}
+	}
+	listenAddrsMu.Unlock()
+	return addrs
+}
+
+func selfIP(addrs []*net.TCPAddr, ips []net.IP) bool {
+	for _, addr := range addrs {
+		for _, ip := range ips {
+			if ip == nil {
+				continue
+			}
+			if addr.IP.IsUnspecified() && isLocalIP(ip) || addr.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the heap is checked against memlimit.
+	shedCheckInterval = time.Second
+
+	// Every check above the limit closes this fraction of the tunnels, at
+	// least one, so the heap has time to shrink before more are closed.
+	shedFraction = 10
+)
+
+// shedder is nil when shedding on memory pressure is disabled.
+var shedder *tunnelShedder
+
+// tunnelShedder closes the oldest tunnels while the heap in use exceeds the
+// limit, to degrade gracefully before the process runs out of memory.
+type tunnelShedder struct {
+	mu      sync.Mutex
+	limit   uint64
+	tunnels map[*tunnel]net.Conn
+}
+
+func newTunnelShedder(limit uint64) *tunnelShedder {
+	return &tunnelShedder{limit: limit, tunnels: make(map[*tunnel]net.Conn)}
+}
+
+func (s *tunnelShedder) add(tun *tunnel, conn net.Conn) {
+	s.mu.Lock()
+	s.tunnels[tun] = conn
+	s.mu.Unlock()
+}
+
+func (s *tunnelShedder) remove(tun *tunnel) {
+	s.mu.Lock()
+	delete(s.tunnels, tun)
+	s.mu.Unlock()
+}
+
+// check closes the oldest tunnels when heap is over the limit, it returns
+// how many were closed.
+func (s *tunnelShedder) check(heap uint64) int {
+	if heap <= s.limit {
+		return 0
+	}
+	s.mu.Lock()
+	tunnels := make([]*tunnel, 0, len(s.tunnels))
+	for tun := range s.tunnels {
+		tunnels = append(tunnels, tun)
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].established.Before(tunnels[j].established)
+	})
+	n := len(tunnels) / shedFraction
+	if n == 0 {
+		n = len(tunnels)
+		if n > 1 {
+			n = 1
+		}
+	}
+	for _, tun := range tunnels[:n] {
+		tun.kill("shed")
+		s.tunnels[tun].Close()
+		delete(s.tunnels, tun)
+	}
+	s.mu.Unlock()
+	if n > 0 {
+		printf("Heap in use %d bytes exceeds %d, closed %d oldest tunnels", heap, s.limit, n)
+	}
+	return n
+}
+
+func (s *tunnelShedder) watch() {
+	var m runtime.MemStats
+	for range time.Tick(shedCheckInterval) {
+		runtime.ReadMemStats(&m)
+		s.check(m.HeapInuse)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// handshaking counts the connections in handshake.
+	handshaking connLimit
+
+	// handling counts the accepted connections until their handlers return,
+	// whether in handshake or tunneling. It's taken by the accept loop
+	// before the handler starts.
+	handling connLimit
+
+	// stopping is 1 after the gateway listeners are closed for shutdown, so
+	// the accept loops exit instead of failing.
+	stopping int32
+
+	gatewayListenersMu sync.Mutex
+	gatewayListeners   = make(map[net.Listener]bool)
+)
+
+func addGatewayListener(l net.Listener) {
+	gatewayListenersMu.Lock()
+	gatewayListeners[l] = true
+	gatewayListenersMu.Unlock()
+}
+
+func removeGatewayListener(l net.Listener) {
+	gatewayListenersMu.Lock()
+	delete(gatewayListeners, l)
+	gatewayListenersMu.Unlock()
+}
+
+// stopAccepting closes the gateway listeners, connections already accepted
+// are not affected.
+func stopAccepting() {
+	atomic.StoreInt32(&stopping, 1)
+	gatewayListenersMu.Lock()
+	defer gatewayListenersMu.Unlock()
+	for l := range gatewayListeners {
+		l.Close()
+	}
+}
+
+// waitHandshakes waits for the connections in handshake to finish, it
+// reports whether they did in timeout.
+func waitHandshakes(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for handshaking.count() != 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
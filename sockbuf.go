@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type targetBuffer struct {
+	pattern string
+	read    int
+	write   int
+}
+
+// parseSockBufs parses a comma separated list of "pattern=read/write" pairs
+// in bytes, or "pattern=size" for both, pattern is matched against the target
+// address by path.Match.
+func parseSockBufs(s string) ([]targetBuffer, error) {
+	var bufs []targetBuffer
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i <= 0 {
+			return nil, errors.New("bad socket buffer: " + item)
+		}
+		pattern := item[:i]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("bad socket buffer pattern: " + pattern)
+		}
+		sizes := strings.Split(item[i+1:], "/")
+		if len(sizes) > 2 {
+			return nil, errors.New("bad socket buffer value: " + item)
+		}
+		read, err := strconv.Atoi(sizes[0])
+		if err != nil || read < 0 {
+			return nil, errors.New("bad socket buffer value: " + item)
+		}
+		write := read
+		if len(sizes) == 2 {
+			write, err = strconv.Atoi(sizes[1])
+			if err != nil || write < 0 {
+				return nil, errors.New("bad socket buffer value: " + item)
+			}
+		}
+		bufs = append(bufs, targetBuffer{pattern, read, write})
+	}
+	return bufs, nil
+}
+
+// setSockBufs applies the buffer sizes of the first pattern matching target
+// to the agent, a zero size keeps the system default.
+func setSockBufs(agent net.Conn, target string) error {
+	for _, b := range cfgSockBufs {
+		if ok, _ := path.Match(b.pattern, target); !ok {
+			continue
+		}
+		conn, ok := agent.(interface {
+			SetReadBuffer(int) error
+			SetWriteBuffer(int) error
+		})
+		if !ok {
+			return nil
+		}
+		if b.read > 0 {
+			if err := conn.SetReadBuffer(b.read); err != nil {
+				return err
+			}
+		}
+		if b.write > 0 {
+			return conn.SetWriteBuffer(b.write)
+		}
+		return nil
+	}
+	return nil
+}
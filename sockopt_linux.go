@@ -0,0 +1,71 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCP_USER_TIMEOUT is not defined by package syscall.
+const tcpUserTimeout = 0x12
+
+// setSockopts applies the configured socket options to a client or agent
+// connection.
+func setSockopts(conn net.Conn) error {
+	if cfgUserTimeout == 0 && cfgCongestion == "" {
+		return nil
+	}
+	return control(conn, func(fd int) error {
+		if cfgUserTimeout != 0 {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, int(time.Duration(cfgUserTimeout)/time.Millisecond)); err != nil {
+				return err
+			}
+		}
+		if cfgCongestion != "" {
+			return syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, cfgCongestion)
+		}
+		return nil
+	})
+}
+
+// copySockBufs sets the socket buffer sizes of agent to the ones of client,
+// so the proxied path behaves closer to the client's own.
+func copySockBufs(client, agent net.Conn) error {
+	var rcvbuf, sndbuf int
+	if err := control(client, func(fd int) (err error) {
+		if rcvbuf, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil {
+			return
+		}
+		sndbuf, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		return
+	}); err != nil || rcvbuf == 0 {
+		return err
+	}
+	// Linux reports doubled sizes and doubles them again when set
+	return control(agent, func(fd int) error {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf/2); err != nil {
+			return err
+		}
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndbuf/2)
+	})
+}
+
+func control(conn net.Conn, fn func(fd int) error) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var err2 error
+	if err := raw.Control(func(fd uintptr) {
+		err2 = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return err2
+}
@@ -0,0 +1,170 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/funny/utest"
+)
+
+func getsockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	var value int
+	err := control(conn, func(fd int) (err error) {
+		value, err = syscall.GetsockoptInt(fd, level, opt)
+		return
+	})
+	utest.IsNilNow(t, err)
+	return value
+}
+
+func Test_UserTimeout(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	oldTimeout := cfgUserTimeout
+	defer func() {
+		cfgUserTimeout = oldTimeout
+	}()
+
+	cfgUserTimeout = 0
+	utest.IsNilNow(t, setSockopts(conn))
+	utest.EqualNow(t, getsockopt(t, conn, syscall.IPPROTO_TCP, tcpUserTimeout), 0)
+
+	cfgUserTimeout = uint(1500 * time.Millisecond)
+	utest.IsNilNow(t, setSockopts(conn))
+	utest.EqualNow(t, getsockopt(t, conn, syscall.IPPROTO_TCP, tcpUserTimeout), 1500)
+}
+
+func getsockoptString(t *testing.T, conn net.Conn, level, opt int) string {
+	buf := make([]byte, 64)
+	size := uint32(len(buf))
+	err := control(conn, func(fd int) error {
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	utest.IsNilNow(t, err)
+	return strings.TrimRight(string(buf[:size]), "\x00")
+}
+
+func Test_Congestion(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	oldCongestion := cfgCongestion
+	defer func() {
+		cfgCongestion = oldCongestion
+	}()
+
+	// reno is always built in and allowed
+	cfgCongestion = "reno"
+	utest.IsNilNow(t, setSockopts(conn))
+	utest.EqualNow(t, getsockoptString(t, conn, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION), "reno")
+
+	cfgCongestion = "no-such-algorithm"
+	utest.NotNilNow(t, setSockopts(conn))
+}
+
+func Test_SockBufs(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	oldBufs := cfgSockBufs
+	defer func() {
+		cfgSockBufs = oldBufs
+	}()
+
+	bufs, err := parseSockBufs("127.0.0.1:*=16384/32768, other:80=65536")
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(bufs), 2)
+	utest.EqualNow(t, bufs[1].read, 65536)
+	utest.EqualNow(t, bufs[1].write, 65536)
+	cfgSockBufs = bufs
+
+	_, err = parseSockBufs("db:3306=1/2/3")
+	utest.NotNilNow(t, err)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	rcvbuf := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	sndbuf := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+
+	// unmatched target keeps the defaults
+	utest.IsNilNow(t, setSockBufs(conn, "10.0.0.1:80"))
+	utest.EqualNow(t, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF), rcvbuf)
+	utest.EqualNow(t, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF), sndbuf)
+
+	// Linux doubles the value for bookkeeping overhead
+	utest.IsNilNow(t, setSockBufs(conn, listener.Addr().String()))
+	utest.EqualNow(t, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF), 2*16384)
+	utest.EqualNow(t, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF), 2*32768)
+}
+
+func Test_CopySockBufs(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	defer client.Close()
+	agent, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	defer agent.Close()
+
+	utest.IsNilNow(t, client.(*net.TCPConn).SetReadBuffer(20000))
+	utest.IsNilNow(t, client.(*net.TCPConn).SetWriteBuffer(30000))
+	utest.IsNilNow(t, copySockBufs(client, agent))
+	utest.EqualNow(t, getsockopt(t, agent, syscall.SOL_SOCKET, syscall.SO_RCVBUF), getsockopt(t, client, syscall.SOL_SOCKET, syscall.SO_RCVBUF))
+	utest.EqualNow(t, getsockopt(t, agent, syscall.SOL_SOCKET, syscall.SO_SNDBUF), getsockopt(t, client, syscall.SOL_SOCKET, syscall.SO_SNDBUF))
+}
+
+func Test_Profile(t *testing.T) {
+	listener := startEchoServer(t)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	oldProfile, oldNoDelay, oldSize := cfgProfile, cfgNoDelay, cfgBufferSize
+	defer func() {
+		cfgProfile, cfgNoDelay, cfgBufferSize = oldProfile, oldNoDelay, oldSize
+	}()
+
+	cfgProfile = "throughput"
+	utest.IsNilNow(t, applyProfile(cfgProfile, nil))
+	utest.EqualNow(t, cfgBufferSize, uint(64*1024))
+	utest.IsNilNow(t, setNoDelay(conn))
+	utest.EqualNow(t, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY), 0)
+
+	cfgProfile = "latency"
+	utest.IsNilNow(t, applyProfile(cfgProfile, nil))
+	utest.EqualNow(t, cfgBufferSize, uint(4*1024))
+	utest.IsNilNow(t, setNoDelay(conn))
+	utest.EqualNow(t, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY), 1)
+
+	// explicit buffer size is kept
+	cfgBufferSize = 1024
+	utest.IsNilNow(t, applyProfile("throughput", map[string]bool{"buffer": true}))
+	utest.EqualNow(t, cfgBufferSize, uint(1024))
+
+	utest.NotNilNow(t, applyProfile("no-such-profile", nil))
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package main
+
+import "net"
+
+// setSockopts is a no-op, the socket options are only supported on Linux.
+func setSockopts(conn net.Conn) error {
+	return nil
+}
+
+// copySockBufs is a no-op, copying socket buffer sizes is only supported on
+// Linux.
+func copySockBufs(client, agent net.Conn) error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statusWindow is how far back the status page counts failures.
+const statusWindow = time.Minute
+
+var (
+	startTime = time.Now()
+
+	// recentConns and recentFailures count the accepted connections and the
+	// failed ones in statusWindow. Failures are the same as logfailures
+	// logs: rejected or failed handshakes, dial errors and abnormal closes.
+	recentConns    = newRecentCounter()
+	recentFailures = newRecentCounter()
+)
+
+// The status page is served by the pprof address, for a quick look without
+// a dashboard.
+func init() {
+	http.HandleFunc("/status", statusPage)
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Gateway status</title></head>
+<body>
+<h1>Gateway {{.Addr}}</h1>
+<table>
+<tr><td>Uptime</td><td>{{.Uptime}}</td></tr>
+<tr><td>Active tunnels</td><td>{{.Active}}</td></tr>
+<tr><td>Total connections</td><td>{{.Total}}</td></tr>
+<tr><td>Failures in {{.Window}}</td><td>{{.Failures}} of {{.Recent}} ({{printf "%.1f" .Rate}}%)</td></tr>
+</table>
+</body>
+</html>
+`))
+
+func statusPage(w http.ResponseWriter, r *http.Request) {
+	recent, failures := recentConns.sum(), recentFailures.sum()
+	rate := 0.0
+	if recent != 0 {
+		rate = float64(failures) * 100 / float64(recent)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, map[string]interface{}{
+		"Addr":     cfgGatewayAddr,
+		"Uptime":   time.Since(startTime).Truncate(time.Second),
+		"Active":   activeTunnels.Value(),
+		"Total":    acceptedConns.Value(),
+		"Window":   statusWindow,
+		"Failures": failures,
+		"Recent":   recent,
+		"Rate":     rate,
+	})
+}
+
+// recentCounter counts events of the last statusWindow by second.
+type recentCounter struct {
+	mu     sync.Mutex
+	counts []int64
+	stamps []int64 // unix second of every count
+}
+
+func newRecentCounter() *recentCounter {
+	n := int(statusWindow / time.Second)
+	return &recentCounter{counts: make([]int64, n), stamps: make([]int64, n)}
+}
+
+func (c *recentCounter) add() {
+	now := time.Now().Unix()
+	i := int(now % int64(len(c.counts)))
+	c.mu.Lock()
+	if c.stamps[i] != now {
+		c.stamps[i], c.counts[i] = now, 0
+	}
+	c.counts[i]++
+	c.mu.Unlock()
+}
+
+func (c *recentCounter) sum() int64 {
+	now := time.Now().Unix()
+	var n int64
+	c.mu.Lock()
+	for i, stamp := range c.stamps {
+		if now-stamp < int64(len(c.counts)) {
+			n += c.counts[i]
+		}
+	}
+	c.mu.Unlock()
+	return n
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// summaryFlush is how often the rows are flushed to the summary CSV, a
+// crash loses the rows of this period at most.
+const summaryFlush = time.Second
+
+// summary is nil when the CSV summary is disabled.
+var summary *tunnelSummary
+
+var summaryHeader = []string{"client", "key", "target", "sent", "received", "duration", "result"}
+
+// tunnelSummary writes a row for every finished connection to a CSV file,
+// including failed handshakes, for offline analysis such as capacity
+// planning. The rows are buffered and flushed every summaryFlush, so memory
+// doesn't grow with the tunnels.
+type tunnelSummary struct {
+	mu   sync.Mutex
+	f    *os.File
+	w    *csv.Writer
+	stop chan struct{}
+}
+
+// openSummary creates the CSV file at path with the header and flushes it
+// until closed.
+func openSummary(path string) (*tunnelSummary, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &tunnelSummary{f: f, w: csv.NewWriter(f), stop: make(chan struct{})}
+	s.w.Write(summaryHeader)
+	if err := s.flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	go s.loop()
+	return s, nil
+}
+
+func (s *tunnelSummary) loop() {
+	ticker := time.NewTicker(summaryFlush)
+	defer ticker.Stop()
+	failed := false
+	for {
+		select {
+		case <-ticker.C:
+			// the error of csv.Writer stays, it's logged once
+			if err := s.flush(); err != nil && !failed {
+				printf("Write summary CSV failed: %s", err)
+				failed = true
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *tunnelSummary) add(tun *tunnel) {
+	row := []string{
+		tun.client,
+		tun.id,
+		tun.target,
+		strconv.FormatInt(tun.sent, 10),
+		strconv.FormatInt(tun.received, 10),
+		tun.transfer.String(),
+		tun.reason,
+	}
+	s.mu.Lock()
+	s.w.Write(row)
+	s.mu.Unlock()
+}
+
+func (s *tunnelSummary) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// close flushes the buffered rows and closes the file.
+func (s *tunnelSummary) close() error {
+	close(s.stop)
+	if err := s.flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
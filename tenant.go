@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Longest key ID accepted in the handshake before the ':' separator.
+	maxKeyIDLen = 16
+
+	// Key ID of the break-glass passphrase, it can't be used by secrets.
+	breakGlassID = "breakglass"
+)
+
+// parseSecrets parses a comma separated list of "id=secret" pairs.
+func parseSecrets(s string) (map[string][]byte, error) {
+	secrets := make(map[string][]byte)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.Index(item, "=")
+		if i <= 0 || i == len(item)-1 {
+			return nil, errors.New("bad secret: " + item)
+		}
+		id := item[:i]
+		if len(id) > maxKeyIDLen || strings.ContainsAny(id, ":\n") {
+			return nil, errors.New("bad key ID: " + id)
+		}
+		if id == breakGlassID {
+			return nil, errors.New("reserved key ID: " + id)
+		}
+		if _, exists := secrets[id]; exists {
+			return nil, errors.New("duplicate key ID: " + id)
+		}
+		secrets[id] = []byte(item[i+1:])
+	}
+	return secrets, nil
+}
+
+// lookupSecret splits the optional "id:" prefix from a handshake line and
+// returns the secret to decrypt the remaining payload with. Lines without
+// key ID use the default passphrase. The secret is nil when no passphrase
+// matches.
+func lookupSecret(line []byte) (id string, secret, payload []byte) {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		if len(cfgSecret) == 0 {
+			return "", nil, line
+		}
+		return "", cfgSecret, line
+	}
+	id = string(line[:i])
+	if id == breakGlassID {
+		return id, cfgBreakGlass, line[i+1:]
+	}
+	return id, cfgSecrets[id], line[i+1:]
+}
+
+// auditBreakGlass reports a handshake decrypted by the break-glass
+// passphrase, every use is logged and published whatever the outcome. It's
+// called right after the decryption, before any check may refuse the
+// handshake. The target is addr as decrypted without the metadata and
+// credentials, it's not validated yet.
+func auditBreakGlass(tun *tunnel, addr string) {
+	if i := strings.IndexByte(addr, '?'); i >= 0 {
+		addr = addr[:i]
+	}
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		addr = addr[i+1:]
+	}
+	tun.id, tun.target = breakGlassID, addr
+	breakGlassUses.Add(1)
+	printf("AUDIT break-glass handshake from %s to %s", tun.client, tun.target)
+	if events != nil {
+		events.publish("breakglass", tun)
+	}
+}
+
+// isBase64 reports whether payload is padded standard base64, as produced
+// by the cipher, without decoding it.
+func isBase64(payload []byte) bool {
+	if len(payload)%4 != 0 {
+		return false
+	}
+	pad := 0
+	for i, c := range payload {
+		switch {
+		case c == '=':
+			// padding only at the end, at most two
+			if i < len(payload)-2 {
+				return false
+			}
+			pad++
+		case pad > 0:
+			return false
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '+', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseAllowList parses a comma separated list of "id=pattern" pairs, a key
+// ID may appear many times to allow several target patterns.
+func parseAllowList(s string) (map[string][]string, error) {
+	allow := make(map[string][]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.Index(item, "=")
+		if i <= 0 || i == len(item)-1 {
+			return nil, errors.New("bad allow rule: " + item)
+		}
+		id, pattern := item[:i], item[i+1:]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("bad allow pattern: " + pattern)
+		}
+		// a literal IPv4-mapped address, brackets escaped, matches as IPv4
+		unescaped := strings.NewReplacer(`\[`, "[", `\]`, "]").Replace(pattern)
+		if target := normalizeTarget(unescaped); target != unescaped {
+			pattern = target
+		}
+		allow[id] = append(allow[id], pattern)
+	}
+	return allow, nil
+}
+
+// allowedTarget reports whether the tenant of key ID may reach target.
+// Tenants without allow rules may reach any target.
+func allowedTarget(id, target string) bool {
+	patterns, ok := cfgAllowList[id]
+	if !ok {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// compileHostRegex compiles the pattern of hostregex, which must match the
+// whole hostname.
+func compileHostRegex(s string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + s + ")$")
+}
+
+// allowedHost reports whether the hostname of target matches hostregex.
+func allowedHost(target string) bool {
+	if cfgHostRe == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	return cfgHostRe.MatchString(host)
+}
+
+// parseExactTargets parses a comma separated list of "host:port" targets,
+// hostnames are compared case insensitively.
+func parseExactTargets(s string) (map[string]bool, error) {
+	var targets map[string]bool
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		// patterns belong to allow, not here
+		if host, port, err := net.SplitHostPort(item); err != nil || host == "" || port == "" || strings.ContainsAny(item, "*?") {
+			return nil, errors.New("bad target: " + item)
+		}
+		if targets == nil {
+			targets = make(map[string]bool)
+		}
+		targets[strings.ToLower(normalizeTarget(item))] = true
+	}
+	return targets, nil
+}
+
+// exactTarget reports whether target is listed by allowexact, any target is
+// allowed when nothing is listed.
+func exactTarget(target string) bool {
+	return cfgExactList == nil || cfgExactList[strings.ToLower(target)]
+}
+
+// loopbackTarget reports whether target is a loopback address, hostnames
+// must resolve to loopback addresses only. Targets are not restricted unless
+// localonly is enabled.
+func loopbackTarget(target string) bool {
+	if !cfgLocalOnly {
+		return true
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfgDialTimeout))
+	defer cancel()
+	addrs, err := lookupHost(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+// loopbackConn reports whether a connection dialed for localonly reached a
+// loopback address. The name of target may resolve otherwise when dialed
+// than when loopbackTarget checked it, such as by DNS rebinding.
+func loopbackConn(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && addr.IP.IsLoopback()
+}
+
+// parseQuotas parses a comma separated list of "id=number" pairs.
+func parseQuotas(s string) (map[string]int64, error) {
+	quotas := make(map[string]int64)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.Index(item, "=")
+		if i <= 0 {
+			return nil, errors.New("bad quota: " + item)
+		}
+		id := item[:i]
+		if _, ok := cfgSecrets[id]; !ok {
+			return nil, errors.New("unknown key ID: " + id)
+		}
+		n, err := strconv.ParseInt(item[i+1:], 10, 64)
+		if err != nil || n <= 0 {
+			return nil, errors.New("bad quota value: " + item)
+		}
+		quotas[id] = n
+	}
+	return quotas, nil
+}
+
+// newTenants creates the usage record of every key ID with its quotas.
+func newTenants(conns, rates map[string]int64) map[string]*tenant {
+	tenants := make(map[string]*tenant, len(cfgSecrets))
+	for id := range cfgSecrets {
+		t := &tenant{maxConns: conns[id]}
+		if rate := rates[id]; rate > 0 {
+			t.limiter = &rateLimiter{rate: rate}
+		}
+		tenants[id] = t
+	}
+	return tenants
+}
+
+type tenant struct {
+	maxConns int64
+	limiter  *rateLimiter
+	conns    connLimit
+	bytes    int64
+}
+
+func (t *tenant) acquire() bool {
+	return t.conns.acquire(t.maxConns)
+}
+
+func (t *tenant) release() {
+	t.conns.release()
+}
+
+// tenantConn counts and limits the traffic of a tenant and releases its
+// connection slot when closed.
+type tenantConn struct {
+	net.Conn
+	tenant *tenant
+	once   sync.Once
+}
+
+func (c *tenantConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.tenant.limiter != nil {
+		c.tenant.limiter.wait(n)
+	}
+	atomic.AddInt64(&c.tenant.bytes, int64(n))
+	return n, err
+}
+
+func (c *tenantConn) Write(p []byte) (int, error) {
+	if c.tenant.limiter != nil {
+		c.tenant.limiter.wait(len(p))
+	}
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.tenant.bytes, int64(n))
+	return n, err
+}
+
+func (c *tenantConn) Close() error {
+	c.once.Do(c.tenant.release)
+	return c.Conn.Close()
+}
+
+// tenantStats reports the usage of every tenant for expvar.
+func tenantStats() interface{} {
+	stats := make(map[string]map[string]int64, len(cfgTenants))
+	for id, t := range cfgTenants {
+		stats[id] = map[string]int64{
+			"conns": t.conns.count(),
+			"bytes": atomic.LoadInt64(&t.bytes),
+		}
+	}
+	return stats
+}
+
+func keyIDs() string {
+	ids := make([]string, 0, len(cfgSecrets))
+	for id := range cfgSecrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// parseUpstream checks the URL of HTTP CONNECT upstream proxy, the user
+// info is used for Basic auth.
+func parseUpstream(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, errors.New("bad upstream URL: " + s)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, errors.New("bad upstream address: " + u.Host)
+	}
+	return u, nil
+}
+
+// upstreamHost is the upstream address without credentials for logging.
+func upstreamHost() string {
+	if cfgUpstreamURL == nil {
+		return ""
+	}
+	return cfgUpstreamURL.Host
+}
+
+func upstreamAuth() string {
+	if cfgBearerToken != "" {
+		return "Bearer " + cfgBearerToken
+	}
+	if user := cfgUpstreamURL.User; user != nil {
+		password, _ := user.Password()
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password))
+	}
+	return ""
+}
+
+// dialUpstream connects to target through the HTTP CONNECT upstream proxy,
+// the timeout covers both dialing the proxy and its response.
+func dialUpstream(target string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dialTimeout("tcp", cfgUpstreamURL.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if auth := upstreamAuth(); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("upstream CONNECT failed: " + resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// target may talk first, keep what was read with the response
+	if r.Buffered() > 0 {
+		return &bufferedConn{conn, r}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}